@@ -0,0 +1,280 @@
+// Package auth authenticates chat clients through ZAP, the ZeroMQ
+// authentication protocol.
+//
+// PLAIN clients are checked against a credentials file holding one
+// "username argon2id-hash" pair per line. CURVE clients are checked
+// against an allow-list holding one "username public-key" pair per line.
+// Either way the handler reports the username as the ZAP User-Id, which
+// the broker reads back from message metadata to decide who a connection
+// may speak as.
+package auth
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	zmq "github.com/pebbe/zmq4"
+	"golang.org/x/crypto/argon2"
+)
+
+// ZAP handlers must bind here, in the same context as the server sockets
+const Endpoint = "inproc://zeromq.zap.01"
+
+// Domain set on the broker's server sockets
+const Domain = "chat"
+
+// Domain set on a federated broker's peering socket
+const PeerDomain = "federation"
+
+// argon2id parameters for new hashes; existing hashes carry their own
+const (
+	argonTime    = 1
+	argonMemory  = 64 * 1024
+	argonThreads = 4
+	argonKeyLen  = 32
+	argonSaltLen = 16
+)
+
+// HashPassword returns an argon2id hash in the usual
+// $argon2id$v=19$m=...,t=...,p=...$salt$key form
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, argonSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, argonTime, argonMemory, argonThreads, argonKeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version,
+		argonMemory, argonTime, argonThreads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// VerifyPassword reports whether password matches an argon2id hash
+func VerifyPassword(encoded, password string) bool {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return false
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false
+	}
+
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false
+	}
+
+	got := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(want)))
+	return subtle.ConstantTimeCompare(got, want) == 1
+}
+
+// readPairs reads "first second" lines, skipping blanks and # comments
+func readPairs(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	pairs := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: want two fields", path, line)
+		}
+		pairs[fields[0]] = fields[1]
+	}
+	return pairs, scanner.Err()
+}
+
+// LoadCredentials reads a username -> password hash file
+func LoadCredentials(path string) (map[string]string, error) {
+	return readPairs(path)
+}
+
+// SetPassword adds or replaces a user's password in a credentials file.
+// The file is rewritten through a temporary file so a crash never leaves
+// it half written.
+func SetPassword(path, username, password string) error {
+	credentials, err := readPairs(path)
+	if os.IsNotExist(err) {
+		credentials = make(map[string]string)
+	} else if err != nil {
+		return err
+	}
+
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+	credentials[username] = hash
+
+	names := make([]string, 0, len(credentials))
+	for name := range credentials {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	writer := bufio.NewWriter(tmp)
+	for _, name := range names {
+		fmt.Fprintf(writer, "%s %s\n", name, credentials[name])
+	}
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0o600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// LoadAllowList reads a username -> Z85 public key file and returns it
+// keyed by public key
+func LoadAllowList(path string) (map[string]string, error) {
+	pairs, err := readPairs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	byKey := make(map[string]string, len(pairs))
+	for username, key := range pairs {
+		byKey[key] = username
+	}
+	return byKey, nil
+}
+
+// Handler answers ZAP requests
+type Handler struct {
+	credentials map[string]string // username -> argon2id hash
+	clientKeys  map[string]string // Z85 public key -> username
+
+	// Clients open a connection per control request, and argon2id is
+	// slow on purpose, so a password that verified is remembered as a
+	// MAC under a key of our own and only hashed again when it changes
+	macKey   []byte
+	verified map[string][]byte // username -> MAC of the accepted password
+}
+
+// NewHandler returns a handler for PLAIN credentials, CURVE client keys,
+// or both. A nil map rejects every client using that mechanism.
+func NewHandler(credentials, clientKeys map[string]string) *Handler {
+	macKey := make([]byte, 32)
+	rand.Read(macKey)
+	return &Handler{
+		credentials: credentials,
+		clientKeys:  clientKeys,
+		macKey:      macKey,
+		verified:    make(map[string][]byte),
+	}
+}
+
+// passwordMAC keys a password to our MAC key, for the verified cache
+func (h *Handler) passwordMAC(password string) []byte {
+	mac := hmac.New(sha256.New, h.macKey)
+	mac.Write([]byte(password))
+	return mac.Sum(nil)
+}
+
+// authenticate returns the username a client proved it owns
+func (h *Handler) authenticate(mechanism string, credentials []string) (string, bool) {
+	switch mechanism {
+	case "PLAIN":
+		if len(credentials) != 2 {
+			return "", false
+		}
+		username, password := credentials[0], credentials[1]
+		hash, exists := h.credentials[username]
+		if !exists {
+			return "", false
+		}
+		mac := h.passwordMAC(password)
+		if known, ok := h.verified[username]; ok && hmac.Equal(known, mac) {
+			return username, true
+		}
+		if !VerifyPassword(hash, password) {
+			return "", false
+		}
+		h.verified[username] = mac
+		return username, true
+
+	case "CURVE":
+		if len(credentials) != 1 {
+			return "", false
+		}
+		username, exists := h.clientKeys[zmq.Z85encode(credentials[0])]
+		return username, exists
+
+	default:
+		return "", false
+	}
+}
+
+// Serve answers ZAP requests on socket, a REP bound to Endpoint, until
+// the socket is closed or its context terminated, which closes it
+func (h *Handler) Serve(socket *zmq.Socket) {
+	for {
+		request, err := socket.RecvMessage(0)
+		if err != nil {
+			if zmq.AsErrno(err) == zmq.ETERM {
+				socket.Close()
+				return
+			}
+			continue
+		}
+
+		// version, request id, domain, address, routing id, mechanism, credentials...
+		if len(request) < 6 || request[0] != "1.0" {
+			socket.SendMessage("1.0", "", "500", "bad ZAP request", "", "")
+			continue
+		}
+		requestID, address, mechanism := request[1], request[3], request[5]
+
+		username, ok := h.authenticate(mechanism, request[6:])
+		if !ok {
+			log.Printf("ZAP: rejected %s client from %s", mechanism, address)
+			socket.SendMessage("1.0", requestID, "400", "authentication failed", "", "")
+			continue
+		}
+		socket.SendMessage("1.0", requestID, "200", "OK", username, "")
+	}
+}
@@ -1,12 +1,260 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/maulikxg/ZeroMQ/chat/auth"
+	"github.com/maulikxg/ZeroMQ/chat/federation"
+	"github.com/maulikxg/ZeroMQ/chat/keys"
+	"github.com/maulikxg/ZeroMQ/chat/protocol"
 	zmq "github.com/pebbe/zmq4"
 )
 
+// Clients say HELLO and then HEARTBEAT on their DEALER; a client silent
+// for this long is forgotten and its name freed
+const userTimeout = 15 * time.Second
+
+// How often brokers gossip their users, and how long a silent peer's
+// users are trusted
+const (
+	gossipInterval = 2 * time.Second
+	peerTimeout    = 3 * gossipInterval
+)
+
+// How long envelope IDs are remembered to drop repeats
+const seenWindow = time.Minute
+
+// Broker relays chat traffic between its own clients and, when federated,
+// other brokers. Every socket is owned by the main loop.
+type Broker struct {
+	id       string
+	xsub     *zmq.Socket
+	xpub     *zmq.Socket
+	router   *zmq.Socket
+	peersOut *zmq.Socket // nil when not federated
+	registry *federation.Registry
+	seen     *federation.Seen
+	routes   *federation.Routes
+	lastID   uint64
+}
+
+// nextID returns a new envelope ID, unique across the federation
+func (b *Broker) nextID() string {
+	b.lastID++
+	return b.id + "/" + strconv.FormatUint(b.lastID, 10)
+}
+
+// forward sends an envelope of our own to the peers. One for a single
+// broker may only travel as far as that broker is.
+func (b *Broker) forward(kind, destination string, payload ...string) {
+	if b.peersOut == nil {
+		return
+	}
+	e := &federation.Envelope{
+		Kind:        kind,
+		Origin:      b.id,
+		ID:          b.nextID(),
+		TTL:         federation.DefaultTTL,
+		Destination: destination,
+		Payload:     payload,
+	}
+	if hops, ok := b.routes.Distance(destination); ok && destination != "" {
+		e.TTL = hops
+	}
+	b.seen.Add(e.ID)
+	b.peersOut.SendMessage(e.Parts()...)
+}
+
+// gossip tells the federation which users are connected here
+func (b *Broker) gossip() {
+	b.forward(federation.Users, "", b.registry.Gossip())
+}
+
+// tell sends a notice to a local client, dropping it if the client is
+// not keeping up
+func (b *Broker) tell(username, command, text string) {
+	protocol.SendDontwait(b.router, protocol.New(command, "", username, text), username)
+}
+
+// register claims a client's name, refusing names held on another broker
+func (b *Broker) register(username string) bool {
+	isNew := !b.registry.IsLocal(username)
+	if home, ok := b.registry.Register(username); !ok {
+		b.tell(username, protocol.Error, fmt.Sprintf("the name %s is taken on broker %s; please reconnect with another", username, home))
+		return false
+	}
+	if isNew {
+		fmt.Printf("%s connected\n", username)
+		b.gossip()
+	}
+	return true
+}
+
+// deliver hands a direct message to a local client, reporting whether it
+// is connected here. With mandatory routing an unknown identity is an
+// error, not a drop, and a blocking send to a client whose queue is full
+// would stall the whole broker, so such a client counts as not connected.
+func (b *Broker) deliver(m *protocol.Message) bool {
+	return b.registry.IsLocal(m.Target) && protocol.SendDontwait(b.router, m, m.Target) == nil
+}
+
+// routePrivate delivers private messages to exactly one client. Clients
+// connect a DEALER whose identity is their username; the sender is taken
+// from the identity frame, so it cannot be forged.
+func (b *Broker) routePrivate() {
+	frames, m, err := protocol.Recv(b.router, 1)
+	if len(frames) != 1 {
+		return
+	}
+	sender := frames[0]
+
+	if err != nil {
+		b.tell(sender, protocol.Error, err.Error())
+		return
+	}
+	if !b.register(sender) {
+		return
+	}
+	m.Sender = sender
+
+	switch m.Command {
+	case protocol.Hello, protocol.Heartbeat:
+		return
+	case protocol.Msg:
+	default:
+		b.tell(sender, protocol.Error, "unknown command "+m.Command)
+		return
+	}
+
+	if b.deliver(m) {
+		return
+	}
+	if home, ok := b.registry.Home(m.Target); ok {
+		b.forward(federation.Direct, home, m.Frames()...)
+		return
+	}
+	b.tell(sender, protocol.System, fmt.Sprintf("%s is not online", m.Target))
+}
+
+// handlePeer processes an envelope from another broker and floods it on
+// to our own peers, or for a DIRECT one, to those nearer its destination
+func (b *Broker) handlePeer(frames []string) {
+	e, err := federation.Decode(frames)
+	if err != nil || e.Origin == b.id {
+		return
+	}
+	if e.Kind == federation.Users {
+		// Every copy counts, as the first need not have come the
+		// shortest way
+		b.routes.Learn(e.Origin, e.Hops())
+	}
+	if !b.seen.Add(e.ID) {
+		return
+	}
+
+	switch e.Kind {
+	case federation.Users:
+		if len(e.Payload) != 1 {
+			return
+		}
+		evicted, err := b.registry.Merge(e.Origin, e.Payload[0])
+		if err != nil {
+			log.Printf("Bad user list from %s: %v", e.Origin, err)
+			return
+		}
+		for _, username := range evicted {
+			b.tell(username, protocol.Error, fmt.Sprintf("the name %s was taken earlier on broker %s; please reconnect with another", username, e.Origin))
+		}
+		if len(evicted) > 0 {
+			b.gossip()
+		}
+
+	case federation.Public:
+		b.xpub.SendMessage(stringsToParts(e.Payload)...)
+
+	case federation.Direct:
+		if e.Destination != b.id {
+			// Only a broker with fewer hops left to the destination than
+			// the envelope may still travel is on a shortest way there
+			if hops, ok := b.routes.Distance(e.Destination); !ok || hops >= e.TTL {
+				return
+			}
+			break
+		}
+		m, err := protocol.Decode(e.Payload)
+		if err != nil {
+			return
+		}
+		if !b.deliver(m) && m.Command == protocol.Msg {
+			// Tell the sender, on whichever broker they are
+			notice := protocol.New(protocol.System, "", m.Sender, fmt.Sprintf("%s is not online", m.Target))
+			b.forward(federation.Direct, e.Origin, notice.Frames()...)
+		}
+		// Delivered here, so there is nobody further to flood it to
+		return
+	}
+
+	if e.TTL > 1 && b.peersOut != nil {
+		e.TTL--
+		b.peersOut.SendMessage(e.Parts()...)
+	}
+}
+
+// expire forgets silent local users and peers
+func (b *Broker) expire() {
+	if expired := b.registry.ExpireLocal(userTimeout); len(expired) > 0 {
+		for _, username := range expired {
+			fmt.Printf("%s disconnected\n", username)
+		}
+		b.gossip()
+	}
+	b.registry.ExpireRemote(peerTimeout)
+	b.routes.Prune()
+	b.seen.Prune()
+}
+
+func stringsToParts(frames []string) []interface{} {
+	parts := make([]interface{}, len(frames))
+	for i, frame := range frames {
+		parts[i] = frame
+	}
+	return parts
+}
+
 func main() {
+	keyDir := flag.String("keys", "", "directory with broker.pub and broker.secret; enables CURVE encryption")
+	peerList := flag.String("peers", "", "comma-separated federation endpoints of other brokers, e.g. tcp://10.0.1.5:5560")
+	federationPort := flag.Int("federation-port", 5560, "port other brokers connect to for federation")
+	id := flag.String("id", "", "name of this broker in the federation; hostname:federation-port if empty")
+	flag.Parse()
+
+	// Load the broker keypair; without one traffic is plaintext
+	var curve *keys.Server
+	if *keyDir != "" {
+		var err error
+		if curve, err = keys.LoadServer(*keyDir); err != nil {
+			log.Fatal("Failed to load broker keys:", err)
+		}
+		fmt.Println("CURVE enabled, broker public key:", curve.Public)
+	}
+
+	// Envelopes carry private messages, so they never cross the network
+	// in the clear
+	if *peerList != "" && curve == nil {
+		log.Fatal("-peers needs -keys: federation forwards private messages and must be encrypted")
+	}
+
+	if *id == "" {
+		host, _ := os.Hostname()
+		*id = fmt.Sprintf("%s:%d", host, *federationPort)
+	}
+
 	// Create ZeroMQ context
 	context, _ := zmq.NewContext()
 	defer context.Term()
@@ -14,15 +262,125 @@ func main() {
 	// Create an XSUB socket (receives messages from clients)
 	xsub, _ := context.NewSocket(zmq.XSUB)
 	defer xsub.Close()
+	curve.Apply(xsub)
 	xsub.Bind("tcp://*:5555") // Clients send messages here
 
 	// Create an XPUB socket (sends messages to clients)
 	xpub, _ := context.NewSocket(zmq.XPUB)
 	defer xpub.Close()
+	curve.Apply(xpub)
 	xpub.Bind("tcp://*:5556") // Clients receive messages from here
 
+	// Create a ROUTER socket (delivers private messages to one client)
+	router, _ := context.NewSocket(zmq.ROUTER)
+	defer router.Close()
+	router.SetRouterMandatory(1)
+	curve.Apply(router)
+	router.Bind("tcp://*:5557") // Clients send and receive private messages here
+
+	broker := &Broker{
+		id:       *id,
+		xsub:     xsub,
+		xpub:     xpub,
+		router:   router,
+		registry: federation.NewRegistry(*id),
+		seen:     federation.NewSeen(seenWindow),
+		routes:   federation.NewRoutes(peerTimeout),
+	}
+
+	poller := zmq.NewPoller()
+	poller.Add(xsub, zmq.POLLIN)
+	poller.Add(xpub, zmq.POLLIN)
+	poller.Add(router, zmq.POLLIN)
+
+	// Federation: we publish envelopes on our own port and subscribe to
+	// each peer's. Peering is one way, so brokers list each other, and
+	// private messages are routed on that assumption. Every broker in the
+	// federation shares the same keypair, and ZAP only lets in peers that
+	// connect with it: anyone else could read the private messages we
+	// forward. ZAP covers a whole context, so the federation sockets get
+	// one of their own and clients are left alone.
+	var peersIn *zmq.Socket
+	if *peerList != "" {
+		peerContext, _ := zmq.NewContext()
+		defer peerContext.Term()
+
+		peersOut, _ := peerContext.NewSocket(zmq.PUB)
+		defer peersOut.Close()
+		zap, _ := peerContext.NewSocket(zmq.REP)
+		if err := zap.Bind(auth.Endpoint); err != nil {
+			log.Fatal("Failed to bind ZAP handler:", err)
+		}
+		go auth.NewHandler(nil, map[string]string{curve.Public: keys.BrokerName}).Serve(zap)
+
+		curve.Apply(peersOut)
+		peersOut.SetZapDomain(auth.PeerDomain)
+		if err := peersOut.Bind(fmt.Sprintf("tcp://*:%d", *federationPort)); err != nil {
+			log.Fatal("Failed to bind federation port:", err)
+		}
+		broker.peersOut = peersOut
+
+		peersIn, _ = peerContext.NewSocket(zmq.SUB)
+		defer peersIn.Close()
+		curve.Peer().Apply(peersIn)
+		peersIn.SetSubscribe("")
+		for _, peer := range strings.Split(*peerList, ",") {
+			if err := peersIn.Connect(strings.TrimSpace(peer)); err != nil {
+				log.Fatalf("Failed to connect to peer %s: %v", peer, err)
+			}
+		}
+		poller.Add(peersIn, zmq.POLLIN)
+		fmt.Printf("Federation enabled as %s, peers: %s\n", *id, *peerList)
+	}
+
 	fmt.Println("Central broker running...")
 
-	// Forward messages between XSUB and XPUB
-	zmq.Proxy(xsub, xpub, nil)
+	// One loop serves every socket, so none is shared between goroutines
+	lastGossip := time.Now()
+	for {
+		polled, err := poller.Poll(gossipInterval / 4)
+		if err != nil {
+			if zmq.AsErrno(err) == zmq.ETERM {
+				return
+			}
+			continue
+		}
+
+		for _, item := range polled {
+			switch item.Socket {
+			case xsub:
+				// Forward public messages to our clients and the federation
+				frames, err := xsub.RecvMessage(0)
+				if err != nil {
+					continue
+				}
+				xpub.SendMessage(stringsToParts(frames)...)
+				broker.forward(federation.Public, "", frames...)
+
+			case xpub:
+				// Pass subscriptions on to the publishers
+				frames, err := xpub.RecvMessage(0)
+				if err != nil {
+					continue
+				}
+				xsub.SendMessage(stringsToParts(frames)...)
+
+			case router:
+				broker.routePrivate()
+
+			case peersIn:
+				frames, err := peersIn.RecvMessage(0)
+				if err != nil {
+					continue
+				}
+				broker.handlePeer(frames)
+			}
+		}
+
+		if time.Since(lastGossip) >= gossipInterval {
+			broker.expire()
+			broker.gossip()
+			lastGossip = time.Now()
+		}
+	}
 }
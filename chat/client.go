@@ -70,26 +70,49 @@ package main
 
 import (
 	"bufio"
+	"flag"
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
+	"github.com/maulikxg/ZeroMQ/chat/keys"
+	"github.com/maulikxg/ZeroMQ/chat/protocol"
 	zmq "github.com/pebbe/zmq4"
 )
 
+// How often we tell the broker we are still here
+const heartbeatInterval = 5 * time.Second
+
 func main() {
+	host := flag.String("host", "localhost", "broker host name or address")
+	brokerKey := flag.String("broker-key", "", "broker.pub of a CURVE broker; plaintext if empty")
+	flag.Parse()
+
+	// Encrypt every broker connection when we know the broker's key
+	var curve *keys.Client
+	if *brokerKey != "" {
+		var err error
+		if curve, err = keys.NewClient(*brokerKey); err != nil {
+			fmt.Println("Failed to load broker key:", err)
+			os.Exit(1)
+		}
+	}
+
 	context, _ := zmq.NewContext()
 	defer context.Term()
 
 	// Create a PUB socket to send messages to the central server
 	publisher, _ := context.NewSocket(zmq.PUB)
 	defer publisher.Close()
-	publisher.Connect("tcp://localhost:5555")
+	curve.Apply(publisher)
+	publisher.Connect(fmt.Sprintf("tcp://%s:5555", *host))
 
 	// Create a SUB socket to receive messages from the central server
 	subscriber, _ := context.NewSocket(zmq.SUB)
 	defer subscriber.Close()
-	subscriber.Connect("tcp://localhost:5556")
+	curve.Apply(subscriber)
+	subscriber.Connect(fmt.Sprintf("tcp://%s:5556", *host))
 	subscriber.SetSubscribe("") // Subscribe to all messages
 
 	// Get the username from the user
@@ -100,20 +123,64 @@ func main() {
 
 	fmt.Println("\nWelcome to the chat, " + username + "! Type '@username message' to send a private message.\n")
 
+	// Create a DEALER socket for private messages. Its identity is our
+	// username, so the broker routes messages for us to this socket only
+	dealer, _ := context.NewSocket(zmq.DEALER)
+	defer dealer.Close()
+	dealer.SetIdentity(username)
+	curve.Apply(dealer)
+	dealer.Connect(fmt.Sprintf("tcp://%s:5557", *host))
+
+	// Private messages to send; the listener goroutine owns the dealer
+	private := make(chan *protocol.Message, 16)
+
 	// Start listening for messages in a separate goroutine
 	go func() {
+		poller := zmq.NewPoller()
+		poller.Add(subscriber, zmq.POLLIN)
+		poller.Add(dealer, zmq.POLLIN)
+
+		// The broker only routes to clients it has heard from recently, so
+		// say hello and keep beating
+		protocol.Send(dealer, protocol.New(protocol.Hello, username, "", ""))
+		lastBeat := time.Now()
+
 		for {
-			msg, _ := subscriber.Recv(0)
-			parts := strings.SplitN(msg, ":", 3) // Format: sender:targetUser:message
+			if time.Since(lastBeat) >= heartbeatInterval {
+				protocol.Send(dealer, protocol.New(protocol.Heartbeat, username, "", ""))
+				lastBeat = time.Now()
+			}
 
-			if len(parts) == 3 {
-				sender := strings.TrimSpace(parts[0])
-				targetUser := strings.TrimSpace(parts[1])
-				message := strings.TrimSpace(parts[2])
+			// Send any private messages typed since the last poll
+			for flushed := false; !flushed; {
+				select {
+				case msg := <-private:
+					protocol.Send(dealer, msg)
+				default:
+					flushed = true
+				}
+			}
 
-				// Show message if it's a group message or meant for this user
-				if targetUser == "all" || targetUser == username {
-					fmt.Printf("\n%s: %s\n", sender, message)
+			polled, err := poller.Poll(100 * time.Millisecond)
+			if err != nil {
+				continue
+			}
+
+			for _, item := range polled {
+				_, msg, err := protocol.Recv(item.Socket, 0)
+				if err != nil {
+					continue
+				}
+
+				// Group messages arrive on the subscriber, private ones on the dealer
+				if msg.Command == protocol.System || msg.Command == protocol.Error {
+					fmt.Printf("\n[System] %s\n", msg.Body)
+					fmt.Print("Enter message: ") // Keep input prompt consistent
+				} else if item.Socket == dealer {
+					fmt.Printf("\n%s (private): %s\n", msg.Sender, msg.Body)
+					fmt.Print("Enter message: ") // Keep input prompt consistent
+				} else if msg.Target == "all" {
+					fmt.Printf("\n%s: %s\n", msg.Sender, msg.Body)
 					fmt.Print("Enter message: ") // Keep input prompt consistent
 				}
 			}
@@ -140,8 +207,13 @@ func main() {
 			}
 		}
 
-		// Send the formatted message
-		publisher.Send(fmt.Sprintf("%s:%s:%s", username, targetUser, message), 0)
+		// Send the formatted message; private ones only go to the broker's router
+		msg := protocol.New(protocol.Msg, username, targetUser, message)
+		if targetUser == "all" {
+			protocol.Send(publisher, msg)
+		} else {
+			private <- msg
+		}
 		fmt.Printf("You to %s: %s\n", targetUser, message)
 	}
 
@@ -0,0 +1,306 @@
+// Package federation lets chat brokers share their users and messages.
+//
+// Every broker binds a PUB socket and connects a SUB to each configured
+// peer. Everything a broker learns or is asked to forward is wrapped in an
+// envelope:
+//
+//	version | kind | origin | id | ttl | destination | payload...
+//
+// Envelopes are flooded: a broker publishes what it receives on to its
+// own peers, so brokers that are not peered directly still hear each
+// other. Seeing each envelope ID once and a hop limit keep flooding from
+// looping. A DIRECT envelope goes no further than it must: brokers learn
+// how many hops away every other one is from its gossip, and pass one on
+// only when they are on a shortest way to its destination.
+package federation
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Version is carried in the first frame of every envelope
+const Version = "1"
+
+// Envelope kinds
+const (
+	Users  = "USERS"  // the origin's connected users, as JSON
+	Public = "PUBLIC" // a public chat message, in its wire frames
+	Direct = "DIRECT" // a direct message for a user on the destination
+)
+
+// Hops an envelope may travel
+const DefaultTTL = 8
+
+var ErrMalformed = errors.New("malformed federation envelope")
+
+// Envelope is one message between brokers
+type Envelope struct {
+	Kind        string
+	Origin      string
+	ID          string
+	TTL         int
+	Destination string // broker a DIRECT envelope is for
+	Payload     []string
+}
+
+// Parts encodes e for SendMessage
+func (e *Envelope) Parts() []interface{} {
+	parts := []interface{}{Version, e.Kind, e.Origin, e.ID, strconv.Itoa(e.TTL), e.Destination}
+	for _, frame := range e.Payload {
+		parts = append(parts, frame)
+	}
+	return parts
+}
+
+// Hops is how many brokers an envelope sent with DefaultTTL, as gossip
+// is, crossed to reach us, counting its origin
+func (e *Envelope) Hops() int {
+	return DefaultTTL - e.TTL + 1
+}
+
+// Decode parses envelope frames
+func Decode(frames []string) (*Envelope, error) {
+	if len(frames) < 6 {
+		return nil, fmt.Errorf("%w: got %d frames", ErrMalformed, len(frames))
+	}
+	if frames[0] != Version {
+		return nil, fmt.Errorf("%w: version %q", ErrMalformed, frames[0])
+	}
+	ttl, err := strconv.Atoi(frames[4])
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad ttl %q", ErrMalformed, frames[4])
+	}
+	if frames[2] == "" || frames[3] == "" {
+		return nil, fmt.Errorf("%w: missing origin or id", ErrMalformed)
+	}
+	return &Envelope{
+		Kind:        frames[1],
+		Origin:      frames[2],
+		ID:          frames[3],
+		TTL:         ttl,
+		Destination: frames[5],
+		Payload:     frames[6:],
+	}, nil
+}
+
+// Seen remembers recent envelope IDs so each is handled once
+type Seen struct {
+	ids    map[string]time.Time
+	window time.Duration
+}
+
+// NewSeen remembers IDs for window, which must outlast the time an
+// envelope takes to cross the federation
+func NewSeen(window time.Duration) *Seen {
+	return &Seen{ids: make(map[string]time.Time), window: window}
+}
+
+// Add records id and reports whether it is new
+func (s *Seen) Add(id string) bool {
+	if _, ok := s.ids[id]; ok {
+		return false
+	}
+	s.ids[id] = time.Now()
+	return true
+}
+
+// Prune forgets IDs older than the window
+func (s *Seen) Prune() {
+	for id, when := range s.ids {
+		if time.Since(when) > s.window {
+			delete(s.ids, id)
+		}
+	}
+}
+
+type route struct {
+	hops  int
+	heard time.Time
+}
+
+// Routes remembers how many hops away each broker is, from the envelopes
+// of its gossip. Peering is mutual, so our envelopes take as many hops to
+// reach a broker as its gossip takes to reach us. It is not safe for
+// concurrent use; the broker's main loop owns it.
+type Routes struct {
+	routes map[string]route
+	window time.Duration
+}
+
+// NewRoutes trusts what it learned of a broker for window, which must
+// outlast the time between two of its gossips
+func NewRoutes(window time.Duration) *Routes {
+	return &Routes{routes: make(map[string]route), window: window}
+}
+
+// Learn records that gossip from broker reached us in hops. Every copy of
+// a flooded envelope arrives, one per way it came, so the fewest hops
+// heard within the window are the shortest way there.
+func (r *Routes) Learn(broker string, hops int) {
+	if old, ok := r.routes[broker]; ok && old.hops < hops && time.Since(old.heard) <= r.window {
+		return
+	}
+	r.routes[broker] = route{hops: hops, heard: time.Now()}
+}
+
+// Distance returns the fewest hops to broker, if its gossip has reached
+// us lately
+func (r *Routes) Distance(broker string) (int, bool) {
+	route, ok := r.routes[broker]
+	if !ok || time.Since(route.heard) > r.window {
+		return 0, false
+	}
+	return route.hops, true
+}
+
+// Prune forgets brokers not heard from within the window
+func (r *Routes) Prune() {
+	for broker, route := range r.routes {
+		if time.Since(route.heard) > r.window {
+			delete(r.routes, broker)
+		}
+	}
+}
+
+type localUser struct {
+	since    time.Time // when the name was taken, which decides conflicts
+	lastSeen time.Time
+}
+
+type remoteUser struct {
+	broker string
+	since  time.Time
+}
+
+// Registry is a broker's view of who is connected where. It is not safe
+// for concurrent use; the broker's main loop owns it.
+type Registry struct {
+	self      string
+	local     map[string]*localUser
+	remote    map[string]*remoteUser
+	heardFrom map[string]time.Time // broker -> last gossip
+}
+
+func NewRegistry(self string) *Registry {
+	return &Registry{
+		self:      self,
+		local:     make(map[string]*localUser),
+		remote:    make(map[string]*remoteUser),
+		heardFrom: make(map[string]time.Time),
+	}
+}
+
+// Register claims name for a user connected here. It reports false and
+// the broker holding the name when it is taken elsewhere.
+func (r *Registry) Register(name string) (string, bool) {
+	if user, ok := r.local[name]; ok {
+		user.lastSeen = time.Now()
+		return "", true
+	}
+	if user, ok := r.remote[name]; ok {
+		return user.broker, false
+	}
+	// Claims are compared in milliseconds, as gossiped
+	now := time.UnixMilli(time.Now().UnixMilli())
+	r.local[name] = &localUser{since: now, lastSeen: now}
+	return "", true
+}
+
+// IsLocal reports whether name is connected to this broker
+func (r *Registry) IsLocal(name string) bool {
+	_, ok := r.local[name]
+	return ok
+}
+
+// Home returns the broker name is connected to, if it is elsewhere
+func (r *Registry) Home(name string) (string, bool) {
+	user, ok := r.remote[name]
+	if !ok {
+		return "", false
+	}
+	return user.broker, true
+}
+
+// ExpireLocal drops users not heard from within timeout and returns them
+func (r *Registry) ExpireLocal(timeout time.Duration) []string {
+	var expired []string
+	for name, user := range r.local {
+		if time.Since(user.lastSeen) > timeout {
+			delete(r.local, name)
+			expired = append(expired, name)
+		}
+	}
+	return expired
+}
+
+// ExpireRemote forgets the users of brokers not heard from within timeout
+func (r *Registry) ExpireRemote(timeout time.Duration) {
+	for broker, when := range r.heardFrom {
+		if time.Since(when) > timeout {
+			delete(r.heardFrom, broker)
+			r.dropBroker(broker)
+		}
+	}
+}
+
+func (r *Registry) dropBroker(broker string) {
+	for name, user := range r.remote {
+		if user.broker == broker {
+			delete(r.remote, name)
+		}
+	}
+}
+
+// Gossip encodes this broker's users for a USERS envelope
+func (r *Registry) Gossip() string {
+	users := make(map[string]int64, len(r.local))
+	for name, user := range r.local {
+		users[name] = user.since.UnixMilli()
+	}
+	payload, _ := json.Marshal(users)
+	return string(payload)
+}
+
+// wins decides a name claimed on two brokers: the older claim keeps it,
+// and the lower broker name breaks a tie
+func wins(since time.Time, broker string, otherSince time.Time, otherBroker string) bool {
+	if !since.Equal(otherSince) {
+		return since.Before(otherSince)
+	}
+	return broker < otherBroker
+}
+
+// Merge replaces what we know of broker's users with its latest gossip.
+// It returns the local users who lost their name to an older claim there
+// and must be disconnected.
+func (r *Registry) Merge(broker, payload string) ([]string, error) {
+	var users map[string]int64
+	if err := json.Unmarshal([]byte(payload), &users); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+
+	r.heardFrom[broker] = time.Now()
+	r.dropBroker(broker)
+
+	var evicted []string
+	for name, millis := range users {
+		since := time.UnixMilli(millis)
+
+		if user, ok := r.local[name]; ok {
+			if wins(user.since, r.self, since, broker) {
+				continue
+			}
+			delete(r.local, name)
+			evicted = append(evicted, name)
+		}
+		if other, ok := r.remote[name]; ok && wins(other.since, other.broker, since, broker) {
+			continue
+		}
+		r.remote[name] = &remoteUser{broker: broker, since: since}
+	}
+	return evicted, nil
+}
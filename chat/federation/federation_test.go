@@ -0,0 +1,213 @@
+package federation
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestWins(t *testing.T) {
+	earlier := time.UnixMilli(1000)
+	later := time.UnixMilli(2000)
+
+	tests := []struct {
+		name        string
+		since       time.Time
+		broker      string
+		otherSince  time.Time
+		otherBroker string
+		want        bool
+	}{
+		{"older claim", earlier, "b", later, "a", true},
+		{"newer claim", later, "a", earlier, "b", false},
+		{"tie, lower broker", earlier, "a", earlier, "b", true},
+		{"tie, higher broker", earlier, "b", earlier, "a", false},
+		{"same claim", earlier, "a", earlier, "a", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := wins(tt.since, tt.broker, tt.otherSince, tt.otherBroker); got != tt.want {
+				t.Errorf("wins = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// gossip encodes users the way Registry.Gossip does
+func gossip(t *testing.T, users map[string]int64) string {
+	t.Helper()
+	payload, err := json.Marshal(users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(payload)
+}
+
+func TestMerge(t *testing.T) {
+	type claim struct {
+		broker string
+		since  int64
+	}
+
+	tests := []struct {
+		name   string
+		self   string
+		local  map[string]int64 // name -> since, claimed here
+		remote map[string]claim // known from earlier gossip
+		from   string
+		users  map[string]int64
+
+		wantEvicted []string
+		wantLocal   []string
+		wantHome    map[string]string // name -> broker, for names held elsewhere
+	}{
+		{
+			name:     "new names",
+			self:     "b",
+			from:     "a",
+			users:    map[string]int64{"alice": 1000, "bob": 2000},
+			wantHome: map[string]string{"alice": "a", "bob": "a"},
+		},
+		{
+			name:        "older claim there evicts ours",
+			self:        "b",
+			local:       map[string]int64{"alice": 2000},
+			from:        "a",
+			users:       map[string]int64{"alice": 1000},
+			wantEvicted: []string{"alice"},
+			wantHome:    map[string]string{"alice": "a"},
+		},
+		{
+			name:      "older claim here keeps ours",
+			self:      "b",
+			local:     map[string]int64{"alice": 1000},
+			from:      "a",
+			users:     map[string]int64{"alice": 2000},
+			wantLocal: []string{"alice"},
+			wantHome:  map[string]string{},
+		},
+		{
+			name:      "tie goes to the lower broker name, us",
+			self:      "a",
+			local:     map[string]int64{"alice": 1000},
+			from:      "b",
+			users:     map[string]int64{"alice": 1000},
+			wantLocal: []string{"alice"},
+			wantHome:  map[string]string{},
+		},
+		{
+			name:        "tie goes to the lower broker name, them",
+			self:        "b",
+			local:       map[string]int64{"alice": 1000},
+			from:        "a",
+			users:       map[string]int64{"alice": 1000},
+			wantEvicted: []string{"alice"},
+			wantHome:    map[string]string{"alice": "a"},
+		},
+		{
+			name:     "older claim on a third broker stands",
+			self:     "c",
+			remote:   map[string]claim{"alice": {"b", 1000}},
+			from:     "a",
+			users:    map[string]int64{"alice": 2000},
+			wantHome: map[string]string{"alice": "b"},
+		},
+		{
+			name:     "newer claim on a third broker loses",
+			self:     "c",
+			remote:   map[string]claim{"alice": {"b", 2000}},
+			from:     "a",
+			users:    map[string]int64{"alice": 1000},
+			wantHome: map[string]string{"alice": "a"},
+		},
+		{
+			name:     "tie between two other brokers",
+			self:     "c",
+			remote:   map[string]claim{"alice": {"b", 1000}},
+			from:     "a",
+			users:    map[string]int64{"alice": 1000},
+			wantHome: map[string]string{"alice": "a"},
+		},
+		{
+			name:     "latest gossip replaces the broker's users",
+			self:     "c",
+			remote:   map[string]claim{"alice": {"a", 1000}, "bob": {"b", 1000}},
+			from:     "a",
+			users:    map[string]int64{"carol": 1000},
+			wantHome: map[string]string{"bob": "b", "carol": "a"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRegistry(tt.self)
+			for name, since := range tt.local {
+				r.local[name] = &localUser{since: time.UnixMilli(since), lastSeen: time.Now()}
+			}
+			for name, c := range tt.remote {
+				r.remote[name] = &remoteUser{broker: c.broker, since: time.UnixMilli(c.since)}
+			}
+
+			evicted, err := r.Merge(tt.from, gossip(t, tt.users))
+			if err != nil {
+				t.Fatalf("Merge: %v", err)
+			}
+			sort.Strings(evicted)
+			if !reflect.DeepEqual(evicted, tt.wantEvicted) {
+				t.Errorf("evicted %v, want %v", evicted, tt.wantEvicted)
+			}
+
+			var local []string
+			for name := range r.local {
+				local = append(local, name)
+			}
+			sort.Strings(local)
+			if !reflect.DeepEqual(local, tt.wantLocal) {
+				t.Errorf("local users %v, want %v", local, tt.wantLocal)
+			}
+
+			homes := make(map[string]string)
+			for name, user := range r.remote {
+				homes[name] = user.broker
+			}
+			if !reflect.DeepEqual(homes, tt.wantHome) {
+				t.Errorf("remote users %v, want %v", homes, tt.wantHome)
+			}
+		})
+	}
+}
+
+func TestMergeMalformed(t *testing.T) {
+	r := NewRegistry("b")
+	if _, err := r.Merge("a", "not json"); !errors.Is(err, ErrMalformed) {
+		t.Errorf("Merge of a bad payload: %v, want ErrMalformed", err)
+	}
+}
+
+func TestRegisterTakenElsewhere(t *testing.T) {
+	r := NewRegistry("b")
+	if _, err := r.Merge("a", gossip(t, map[string]int64{"alice": 1000})); err != nil {
+		t.Fatal(err)
+	}
+	if home, ok := r.Register("alice"); ok || home != "a" {
+		t.Errorf("Register(alice) = %q, %v, want a, false", home, ok)
+	}
+	if _, ok := r.Register("bob"); !ok {
+		t.Error("Register(bob) refused a free name")
+	}
+}
+
+func TestRoutesKeepFewestHops(t *testing.T) {
+	r := NewRoutes(time.Minute)
+	for _, hops := range []int{3, 1, 2} {
+		r.Learn("a", hops)
+	}
+	if hops, ok := r.Distance("a"); !ok || hops != 1 {
+		t.Errorf("Distance(a) = %d, %v, want 1, true", hops, ok)
+	}
+	if _, ok := r.Distance("b"); ok {
+		t.Error("Distance(b) known without gossip")
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"path/filepath"
+
+	"github.com/maulikxg/ZeroMQ/chat/keys"
+)
+
+func main() {
+	dir := flag.String("dir", "keys", "directory to write the key files into")
+	name := flag.String("name", keys.BrokerName, "keypair name; use a username for a client keypair")
+	flag.Parse()
+
+	// Create a long-term CURVE keypair
+	public, err := keys.Generate(*dir, *name)
+	if err != nil {
+		log.Fatal("Failed to generate keys:", err)
+	}
+
+	fmt.Printf("Public key for %s: %s\n", *name, public)
+	if *name == keys.BrokerName {
+		fmt.Printf("Start the broker with -keys %s and give clients %s\n", *dir, filepath.Join(*dir, keys.PublicFile(*name)))
+	} else {
+		fmt.Printf("Add \"%s %s\" to the broker's allow-list and start the client with -key %s\n",
+			*name, public, filepath.Join(*dir, keys.SecretFile(*name)))
+	}
+	fmt.Println("Keep", filepath.Join(*dir, keys.SecretFile(*name)), "private")
+}
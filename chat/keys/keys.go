@@ -0,0 +1,178 @@
+// Package keys manages the CurveZMQ keys used to encrypt chat traffic.
+//
+// A keypair is stored as two Z85 text files, <name>.pub and <name>.secret.
+// The broker always has one, named "broker". Clients only need broker.pub
+// and normally create a throwaway keypair each time they start; a broker
+// that allow-lists client keys needs clients with long-term keypairs too.
+package keys
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	zmq "github.com/pebbe/zmq4"
+)
+
+// Name of the broker's keypair
+const BrokerName = "broker"
+
+// PublicFile and SecretFile name the two files of a keypair
+func PublicFile(name string) string { return name + ".pub" }
+func SecretFile(name string) string { return name + ".secret" }
+
+// Z85 encoded CURVE keys are always 40 characters
+const keyLength = 40
+
+// Generate writes a new keypair called name into dir. Existing keys are
+// never overwritten, since every peer would have to be given the new one.
+func Generate(dir, name string) (public string, err error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+
+	publicPath := filepath.Join(dir, PublicFile(name))
+	secretPath := filepath.Join(dir, SecretFile(name))
+	for _, path := range []string{publicPath, secretPath} {
+		if _, err := os.Stat(path); err == nil {
+			return "", fmt.Errorf("%s already exists", path)
+		}
+	}
+
+	public, secret, err := zmq.NewCurveKeypair()
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.WriteFile(secretPath, []byte(secret+"\n"), 0o600); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(publicPath, []byte(public+"\n"), 0o644); err != nil {
+		return "", err
+	}
+	return public, nil
+}
+
+// ReadKey reads one Z85 key file
+func ReadKey(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	key := strings.TrimSpace(string(data))
+	if len(key) != keyLength {
+		return "", fmt.Errorf("%s: not a Z85 CURVE key", path)
+	}
+	return key, nil
+}
+
+// Server is the broker's long-term keypair
+type Server struct {
+	Public string
+	Secret string
+}
+
+// readSecret reads a secret key file, refusing files that other users
+// can read
+func readSecret(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if info.Mode().Perm()&0o077 != 0 {
+		return "", fmt.Errorf("%s is accessible by other users; chmod 600 it", path)
+	}
+	return ReadKey(path)
+}
+
+// LoadServer reads the broker keypair from dir
+func LoadServer(dir string) (*Server, error) {
+	secret, err := readSecret(filepath.Join(dir, SecretFile(BrokerName)))
+	if err != nil {
+		return nil, err
+	}
+	public, err := ReadKey(filepath.Join(dir, PublicFile(BrokerName)))
+	if err != nil {
+		return nil, err
+	}
+	return &Server{Public: public, Secret: secret}, nil
+}
+
+// Apply makes socket a CURVE server. It must be called before Bind. A nil
+// Server leaves the socket in plaintext.
+func (s *Server) Apply(socket *zmq.Socket) error {
+	if s == nil {
+		return nil
+	}
+	return errors.Join(
+		socket.SetCurveServer(1),
+		socket.SetCurveSecretkey(s.Secret),
+	)
+}
+
+// Peer is the client side of s, for a broker connecting to another
+// broker of its federation. They share the keypair, and holding its
+// secret is what proves a peer belongs. A nil Server has no peer side.
+func (s *Server) Peer() *Client {
+	if s == nil {
+		return nil
+	}
+	return &Client{ServerPublic: s.Public, Public: s.Public, Secret: s.Secret}
+}
+
+// Client holds the broker's public key and this client's session keypair
+type Client struct {
+	ServerPublic string
+	Public       string
+	Secret       string
+}
+
+// NewClient loads the broker public key from path and generates a fresh
+// client keypair
+func NewClient(path string) (*Client, error) {
+	serverPublic, err := ReadKey(path)
+	if err != nil {
+		return nil, err
+	}
+
+	public, secret, err := zmq.NewCurveKeypair()
+	if err != nil {
+		return nil, err
+	}
+	return &Client{ServerPublic: serverPublic, Public: public, Secret: secret}, nil
+}
+
+// LoadClient is NewClient for a client with a long-term keypair, for
+// brokers that only accept allow-listed keys
+func LoadClient(path, secretPath string) (*Client, error) {
+	serverPublic, err := ReadKey(path)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := readSecret(secretPath)
+	if err != nil {
+		return nil, err
+	}
+	public, err := zmq.AuthCurvePublic(secret)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{ServerPublic: serverPublic, Public: public, Secret: secret}, nil
+}
+
+// Apply makes socket a CURVE client of the broker. It must be called
+// before Connect. A nil Client leaves the socket in plaintext.
+func (c *Client) Apply(socket *zmq.Socket) error {
+	if c == nil {
+		return nil
+	}
+	return errors.Join(
+		socket.SetCurveServerkey(c.ServerPublic),
+		socket.SetCurvePublickey(c.Public),
+		socket.SetCurveSecretkey(c.Secret),
+	)
+}
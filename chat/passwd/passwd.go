@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/maulikxg/ZeroMQ/chat/auth"
+	"github.com/maulikxg/ZeroMQ/chat/protocol"
+)
+
+func main() {
+	file := flag.String("file", "credentials", "credentials file to create or update")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: passwd [-file credentials] username")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	username := flag.Arg(0)
+	if !protocol.ValidUsername(username) {
+		log.Fatal("Usernames must be at most 32 printable characters without spaces")
+	}
+
+	// The password is echoed, so run this where nobody is watching
+	fmt.Printf("Password for %s: ", username)
+	reader := bufio.NewReader(os.Stdin)
+	password, _ := reader.ReadString('\n')
+	password = strings.TrimRight(password, "\r\n")
+	if password == "" {
+		log.Fatal("Password cannot be empty")
+	}
+
+	if err := auth.SetPassword(*file, username, password); err != nil {
+		log.Fatal("Failed to update credentials:", err)
+	}
+	fmt.Println("Password set for", username, "in", *file)
+}
@@ -0,0 +1,333 @@
+// Package protocol defines the multipart wire format shared by the chat
+// brokers and clients.
+//
+// Every message is sent as seven frames:
+//
+//	version | command | sender | target | id | timestamp | body
+//
+// version is a single byte, timestamp is Unix milliseconds in decimal and
+// every other frame is an arbitrary string. Because fields are separate
+// frames, names and text may contain any character, ':' included.
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	zmq "github.com/pebbe/zmq4"
+)
+
+// Version is the protocol version carried in the first frame
+const Version byte = 1
+
+// Commands
+const (
+	Register   = "REGISTER"
+	Resume     = "RESUME"
+	Unregister = "UNREGISTER"
+	Whois      = "WHOIS"
+	List       = "LIST"
+	Nick       = "NICK"
+	Away       = "AWAY"
+	Heartbeat  = "HEARTBEAT"
+	Hello      = "HELLO"
+	Join       = "JOIN"
+	JoinOK     = "JOIN_OK"
+	JoinFail   = "JOIN_FAIL"
+	Leave      = "LEAVE"
+	LeaveOK    = "LEAVE_OK"
+	Rooms      = "ROOMS"
+	History    = "HISTORY"
+	Msg        = "MSG"
+	System     = "SYSTEM"
+	Error      = "ERROR"
+)
+
+// File transfer handshake on the direct channel. An OFFER body is
+// "<size> <name>"; the broker gives the transfer an ID, which ACCEPT and
+// DECLINE carry. The file itself goes over the data channel.
+const (
+	Offer   = "OFFER"
+	Accept  = "ACCEPT"
+	Decline = "DECLINE"
+)
+
+// ParseOffer splits an OFFER body into the file size and name
+func ParseOffer(body string) (int64, string, bool) {
+	sizeText, name, ok := strings.Cut(body, " ")
+	size, err := strconv.ParseInt(sizeText, 10, 64)
+	if !ok || err != nil || size < 0 || name == "" {
+		return 0, "", false
+	}
+	return size, name, true
+}
+
+// Changes to a chat message, which only its author or an admin may make.
+// The ID field holds the broker's ID of the message, and the change goes
+// wherever the message went: to its room, or to both ends of a private
+// conversation. An EDIT body is the new text; a DELETE has none. Both are
+// accepted only on the direct channel, where the broker knows the sender.
+const (
+	Edit   = "EDIT"
+	Delete = "DELETE"
+)
+
+// Public keys for end-to-end encrypted private messages, on the control
+// endpoint. SETKEY publishes the sender's key, its body being the
+// session token and the key separated by a space; GETKEY asks for the key
+// of its target, which an OK reply holds.
+const (
+	SetKey = "SETKEY"
+	GetKey = "GETKEY"
+)
+
+// Room membership changes, published on the room's topic next to the
+// SYSTEM line announcing them so programs need not parse its text. The
+// sender is the user who joined or left, the target the room.
+const (
+	Joined = "JOINED"
+	Left   = "LEFT"
+)
+
+// Moderation requests on the control endpoint, which the broker only
+// takes from admins. The target is a username, or for BAN and UNBAN also
+// a peer address. Every body starts with the admin's session token; a
+// MUTE goes on with "<duration> [reason]", the others with an optional
+// reason. Users who are kicked or banned are sent KICKED on the direct
+// channel and should not reconnect.
+const (
+	Kick   = "KICK"
+	Ban    = "BAN"
+	Unban  = "UNBAN"
+	Mute   = "MUTE"
+	Kicked = "KICKED"
+)
+
+// The broker answers every HEARTBEAT on the direct channel with one of
+// these, so clients notice when it is gone or has forgotten them
+const (
+	SessionOK      = "ok"
+	SessionUnknown = "unknown"
+)
+
+// Delivery status. The broker answers every accepted MSG with an ACK
+// whose ID is the message ID it assigned and whose body is the ID the
+// client sent. Recipients of a direct message report DELIVERED once it
+// arrives and READ once their user has seen it, both carrying the
+// broker's ID.
+const (
+	Ack       = "ACK"
+	Delivered = "DELIVERED"
+	Read      = "READ"
+)
+
+// Replies on the control endpoint. An OK body holds the result, an ERR
+// body holds one of the error codes below. The result of REGISTER is a
+// session token, which RESUME presents to take the name back after a
+// lost connection. UNREGISTER and NICK present it as their body too; an
+// UNREGISTER may add a reason after it, separated by a space.
+const (
+	OK  = "OK"
+	Err = "ERR"
+)
+
+// Control error codes
+const (
+	CodeTaken       = "TAKEN"
+	CodeInvalidName = "INVALID_NAME"
+	CodeUnknownUser = "UNKNOWN_USER"
+	CodeBadRequest  = "BAD_REQUEST"
+	CodeForbidden   = "FORBIDDEN"
+	CodeRateLimited = "RATE_LIMITED"
+	CodeBanned      = "BANNED"
+)
+
+// Number of frames in an encoded message
+const frameCount = 7
+
+var (
+	ErrMalformed = errors.New("malformed message")
+	ErrVersion   = errors.New("unsupported protocol version")
+)
+
+// Message is one protocol message
+type Message struct {
+	Command string    `json:"command"`
+	Sender  string    `json:"sender"`
+	Target  string    `json:"target"`
+	ID      string    `json:"id,omitempty"`
+	Time    time.Time `json:"time"`
+	Body    string    `json:"body"`
+}
+
+// New returns a message stamped with the current time
+func New(command, sender, target, body string) *Message {
+	return &Message{
+		Command: command,
+		Sender:  sender,
+		Target:  target,
+		Time:    time.Now(),
+		Body:    body,
+	}
+}
+
+// Frames encodes m as its wire frames
+func (m *Message) Frames() []string {
+	return []string{
+		string([]byte{Version}),
+		m.Command,
+		m.Sender,
+		m.Target,
+		m.ID,
+		strconv.FormatInt(m.Time.UnixMilli(), 10),
+		m.Body,
+	}
+}
+
+// Decode parses wire frames, rejecting unknown versions and malformed input
+func Decode(frames []string) (*Message, error) {
+	if len(frames) == 0 || len(frames[0]) != 1 {
+		return nil, fmt.Errorf("%w: missing version frame", ErrMalformed)
+	}
+	if frames[0][0] != Version {
+		return nil, fmt.Errorf("%w %d", ErrVersion, frames[0][0])
+	}
+	if len(frames) != frameCount {
+		return nil, fmt.Errorf("%w: got %d frames, want %d", ErrMalformed, len(frames), frameCount)
+	}
+	if frames[1] == "" {
+		return nil, fmt.Errorf("%w: empty command", ErrMalformed)
+	}
+
+	millis, err := strconv.ParseInt(frames[5], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad timestamp %q", ErrMalformed, frames[5])
+	}
+
+	return &Message{
+		Command: frames[1],
+		Sender:  frames[2],
+		Target:  frames[3],
+		ID:      frames[4],
+		Time:    time.UnixMilli(millis),
+		Body:    frames[6],
+	}, nil
+}
+
+// Send writes m to socket after any routing frames (a topic for PUB, an
+// identity for ROUTER)
+func Send(socket *zmq.Socket, m *Message, prefix ...string) error {
+	parts := make([]interface{}, 0, len(prefix)+frameCount)
+	for _, frame := range prefix {
+		parts = append(parts, frame)
+	}
+	for _, frame := range m.Frames() {
+		parts = append(parts, frame)
+	}
+	_, err := socket.SendMessage(parts...)
+	return err
+}
+
+// SendDontwait is Send failing with EAGAIN instead of blocking when the
+// peer's queue is full
+func SendDontwait(socket *zmq.Socket, m *Message, prefix ...string) error {
+	parts := make([]interface{}, 0, len(prefix)+frameCount)
+	for _, frame := range prefix {
+		parts = append(parts, frame)
+	}
+	for _, frame := range m.Frames() {
+		parts = append(parts, frame)
+	}
+	_, err := socket.SendMessageDontwait(parts...)
+	return err
+}
+
+// Recv reads one message whose first prefixLen frames are routing frames.
+// The routing frames are returned even when decoding fails so the caller
+// can send an error reply.
+func Recv(socket *zmq.Socket, prefixLen int) ([]string, *Message, error) {
+	frames, err := socket.RecvMessage(0)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(frames) < prefixLen {
+		return nil, nil, fmt.Errorf("%w: missing routing frames", ErrMalformed)
+	}
+
+	m, err := Decode(frames[prefixLen:])
+	return frames[:prefixLen], m, err
+}
+
+// A chat body starting with actionPrefix is an action, "/me waves" being
+// shown as "* alice waves". Clients that do not know this still show
+// something readable.
+const actionPrefix = "/me "
+
+// Action returns the chat body for an action
+func Action(text string) string {
+	return actionPrefix + text
+}
+
+// IsAction reports whether body is an action and returns its text
+func IsAction(body string) (string, bool) {
+	return strings.CutPrefix(body, actionPrefix)
+}
+
+// A chat body starting with replyPrefix answers an earlier message,
+// "/reply <id> text". The broker only passes a reply on when the message
+// it answers was said in the same room or conversation.
+const replyPrefix = "/reply "
+
+// ReplyTo returns the chat body of a reply to the message with ID parent
+func ReplyTo(parent, text string) string {
+	return replyPrefix + parent + " " + text
+}
+
+// IsReply reports whether body is a reply and splits it into the ID of
+// the message it answers and its text
+func IsReply(body string) (parent, text string, ok bool) {
+	rest, ok := strings.CutPrefix(body, replyPrefix)
+	if !ok {
+		return "", "", false
+	}
+	parent, text, ok = strings.Cut(rest, " ")
+	if !ok || parent == "" {
+		return "", "", false
+	}
+	return parent, text, true
+}
+
+// Topics end in a NUL byte, which names cannot contain, so a subscription
+// to "#dev" never matches "#devops" by prefix
+const topicEnd = "\x00"
+
+// RoomTopic is the PUB topic carrying a room's traffic
+func RoomTopic(room string) string {
+	return "#" + room + topicEnd
+}
+
+// IsRoom reports whether target names a room ("#room") rather than a user
+func IsRoom(target string) bool {
+	return strings.HasPrefix(target, "#")
+}
+
+// ValidUsername accepts up to 32 printable characters without spaces. A
+// leading '#' or '@' is refused so names never look like targets.
+func ValidUsername(name string) bool {
+	if name == "" || len([]rune(name)) > 32 {
+		return false
+	}
+	if strings.HasPrefix(name, "#") || strings.HasPrefix(name, "@") {
+		return false
+	}
+	for _, r := range name {
+		if !unicode.IsPrint(r) || unicode.IsSpace(r) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,530 @@
+// Full-screen chat client for the broker in chat/cent.go. It talks to the
+// broker over the same sockets as chat/client.go, but keeps incoming
+// messages in a scrollback pane so they never overwrite the input line.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/mattn/go-runewidth"
+
+	"github.com/maulikxg/ZeroMQ/chat/keys"
+	"github.com/maulikxg/ZeroMQ/chat/protocol"
+	zmq "github.com/pebbe/zmq4"
+)
+
+// Lines kept in the scrollback pane
+const scrollback = 1000
+
+// How often we tell the broker we are still here
+const heartbeatInterval = 5 * time.Second
+
+// Width of the user list, which is hidden on narrow terminals
+const (
+	sidebarWidth    = 20
+	minWidthSidebar = 60
+)
+
+// Colors senders are drawn in, picked by a hash of the name so everyone
+// keeps the same color
+var senderColors = []tcell.Color{
+	tcell.ColorGreen,
+	tcell.ColorAqua,
+	tcell.ColorFuchsia,
+	tcell.ColorOlive,
+	tcell.ColorTeal,
+	tcell.ColorLime,
+	tcell.ColorSilver,
+	tcell.ColorPurple,
+}
+
+var (
+	styleDefault = tcell.StyleDefault
+	styleTime    = tcell.StyleDefault.Foreground(tcell.ColorGray)
+	styleSystem  = tcell.StyleDefault.Foreground(tcell.ColorYellow)
+	stylePrivate = tcell.StyleDefault.Foreground(tcell.ColorRed)
+	styleBar     = tcell.StyleDefault.Reverse(true)
+)
+
+func senderStyle(name string) tcell.Style {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return tcell.StyleDefault.Foreground(senderColors[h.Sum32()%uint32(len(senderColors))]).Bold(true)
+}
+
+// A cell is one rune and how to draw it
+type cell struct {
+	r     rune
+	style tcell.Style
+}
+
+func appendText(cells []cell, text string, style tcell.Style) []cell {
+	for _, r := range text {
+		cells = append(cells, cell{r, style})
+	}
+	return cells
+}
+
+// ui holds everything the screen shows. It is only touched by the main
+// goroutine.
+type ui struct {
+	screen   tcell.Screen
+	username string
+
+	lines  [][]cell
+	offset int // rows scrolled up from the newest line
+
+	input  []rune
+	cursor int
+
+	// The broker keeps no user list, so the sidebar shows who we have
+	// heard from
+	users map[string]time.Time
+}
+
+// add appends a line to the scrollback. A reader who scrolled up keeps
+// looking at the same lines.
+func (u *ui) add(line []cell) {
+	u.lines = append(u.lines, line)
+	if len(u.lines) > scrollback {
+		u.lines = u.lines[len(u.lines)-scrollback:]
+	}
+	if u.offset > 0 {
+		u.offset += len(wrap(line, u.paneWidth()))
+		u.clamp()
+	}
+}
+
+func (u *ui) system(text string) {
+	line := appendText(nil, time.Now().Format("15:04 "), styleTime)
+	u.add(appendText(line, "* "+text, styleSystem))
+}
+
+// message adds a chat line; to is non-empty for private messages
+func (u *ui) message(m *protocol.Message, to string) {
+	line := appendText(nil, m.Time.Format("15:04 "), styleTime)
+	line = appendText(line, m.Sender, senderStyle(m.Sender))
+	if to != "" {
+		line = appendText(line, " → ", stylePrivate)
+		line = appendText(line, to, senderStyle(to))
+		line = appendText(line, " (private)", stylePrivate)
+	}
+	u.add(appendText(line, ": "+m.Body, styleDefault))
+}
+
+func (u *ui) seen(name string) {
+	if name != "" && name != "all" {
+		u.users[name] = time.Now()
+	}
+}
+
+// gone drops a user who said goodbye from the user list
+func (u *ui) gone(name string) {
+	if name != u.username {
+		delete(u.users, name)
+	}
+}
+
+func (u *ui) paneWidth() int {
+	width, _ := u.screen.Size()
+	if width >= minWidthSidebar {
+		width -= sidebarWidth + 1
+	}
+	return width
+}
+
+// wrap splits a line into rows of at most width columns
+func wrap(line []cell, width int) [][]cell {
+	if width < 1 {
+		return nil
+	}
+	var rows [][]cell
+	start, used := 0, 0
+	for i, c := range line {
+		w := runewidth.RuneWidth(c.r)
+		if used+w > width {
+			rows = append(rows, line[start:i])
+			start, used = i, 0
+		}
+		used += w
+	}
+	return append(rows, line[start:])
+}
+
+// scroll moves the view by delta rows, positive towards older lines
+func (u *ui) scroll(delta int) {
+	u.offset += delta
+	u.clamp()
+}
+
+// clamp keeps the scroll offset within the rows the scrollback holds
+func (u *ui) clamp() {
+	_, height := u.screen.Size()
+	total := 0
+	for _, line := range u.lines {
+		total += len(wrap(line, u.paneWidth()))
+	}
+	visible := height - 2
+
+	if u.offset > total-visible {
+		u.offset = total - visible
+	}
+	if u.offset < 0 {
+		u.offset = 0
+	}
+}
+
+func (u *ui) put(x, y int, cells []cell) int {
+	for _, c := range cells {
+		u.screen.SetContent(x, y, c.r, nil, c.style)
+		x += runewidth.RuneWidth(c.r)
+	}
+	return x
+}
+
+func (u *ui) draw() {
+	u.screen.Clear()
+	width, height := u.screen.Size()
+	paneWidth := u.paneWidth()
+	paneHeight := height - 2
+	if paneHeight < 1 {
+		u.screen.Show()
+		return
+	}
+
+	// Messages, newest at the bottom, shifted up by the scroll offset
+	var rows [][]cell
+	for _, line := range u.lines {
+		rows = append(rows, wrap(line, paneWidth)...)
+	}
+	end := len(rows) - u.offset
+	if end < 0 {
+		end = 0
+	}
+	start := end - paneHeight
+	if start < 0 {
+		start = 0
+	}
+	for i, row := range rows[start:end] {
+		u.put(0, paneHeight-(end-start)+i, row)
+	}
+
+	// User list
+	if paneWidth < width {
+		names := make([]string, 0, len(u.users))
+		for name := range u.users {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for y := 0; y < paneHeight; y++ {
+			u.screen.SetContent(paneWidth, y, tcell.RuneVLine, nil, styleDefault)
+		}
+		u.put(paneWidth+2, 0, appendText(nil, "Users", styleDefault.Bold(true)))
+		for i, name := range names {
+			if i+2 >= paneHeight {
+				break
+			}
+			label := []rune(name)
+			if len(label) > sidebarWidth-2 {
+				label = append(label[:sidebarWidth-3], '…')
+			}
+			u.put(paneWidth+2, i+2, appendText(nil, string(label), senderStyle(name)))
+		}
+	}
+
+	// Status bar
+	status := fmt.Sprintf(" %s | PgUp/PgDn scroll, Esc newest, Ctrl-C quit ", u.username)
+	if u.offset > 0 {
+		status += fmt.Sprintf("| %d rows below ", u.offset)
+	}
+	bar := appendText(nil, status, styleBar)
+	for x := u.put(0, height-2, bar); x < width; x++ {
+		u.screen.SetContent(x, height-2, ' ', nil, styleBar)
+	}
+
+	// Input line, scrolled horizontally so the cursor stays visible
+	prompt := appendText(nil, "> ", styleDefault.Bold(true))
+	room := width - len(prompt) - 1
+	first := 0
+	if u.cursor > room {
+		first = u.cursor - room
+	}
+	x := u.put(0, height-1, prompt)
+	u.put(x, height-1, appendText(nil, string(u.input[first:]), styleDefault))
+	u.screen.ShowCursor(x+runewidth.StringWidth(string(u.input[first:u.cursor])), height-1)
+
+	u.screen.Show()
+}
+
+// edit applies a key to the input line and returns a finished line when
+// Enter was pressed
+func (u *ui) edit(key *tcell.EventKey) (string, bool) {
+	switch key.Key() {
+	case tcell.KeyEnter:
+		line := strings.TrimSpace(string(u.input))
+		u.input, u.cursor = nil, 0
+		return line, true
+	case tcell.KeyBackspace, tcell.KeyBackspace2:
+		if u.cursor > 0 {
+			u.input = append(u.input[:u.cursor-1], u.input[u.cursor:]...)
+			u.cursor--
+		}
+	case tcell.KeyDelete:
+		if u.cursor < len(u.input) {
+			u.input = append(u.input[:u.cursor], u.input[u.cursor+1:]...)
+		}
+	case tcell.KeyLeft:
+		if u.cursor > 0 {
+			u.cursor--
+		}
+	case tcell.KeyRight:
+		if u.cursor < len(u.input) {
+			u.cursor++
+		}
+	case tcell.KeyHome, tcell.KeyCtrlA:
+		u.cursor = 0
+	case tcell.KeyEnd, tcell.KeyCtrlE:
+		u.cursor = len(u.input)
+	case tcell.KeyCtrlU:
+		u.input, u.cursor = nil, 0
+	case tcell.KeyRune:
+		u.input = append(u.input[:u.cursor], append([]rune{key.Rune()}, u.input[u.cursor:]...)...)
+		u.cursor++
+	}
+	return "", false
+}
+
+func main() {
+	host := flag.String("host", "localhost", "broker host name or address")
+	brokerKey := flag.String("broker-key", "", "broker.pub of a CURVE broker; plaintext if empty")
+	flag.Parse()
+
+	// Encrypt every broker connection when we know the broker's key
+	var curve *keys.Client
+	if *brokerKey != "" {
+		var err error
+		if curve, err = keys.NewClient(*brokerKey); err != nil {
+			fmt.Println("Failed to load broker key:", err)
+			os.Exit(1)
+		}
+	}
+
+	// Get the username before the screen takes over the terminal
+	fmt.Print("Enter your name: ")
+	reader := bufio.NewReader(os.Stdin)
+	username, _ := reader.ReadString('\n')
+	username = strings.TrimSpace(username)
+	if username == "" {
+		fmt.Println("Username cannot be empty")
+		os.Exit(1)
+	}
+
+	context, _ := zmq.NewContext()
+	defer context.Term()
+
+	// Create a PUB socket to send messages to the central server
+	publisher, _ := context.NewSocket(zmq.PUB)
+	defer publisher.Close()
+	publisher.SetLinger(time.Second)
+	curve.Apply(publisher)
+	publisher.Connect(fmt.Sprintf("tcp://%s:5555", *host))
+
+	// Say goodbye so other clients drop us from their user lists. The
+	// linger above keeps an unreachable broker from holding up exit.
+	defer protocol.Send(publisher, protocol.New(protocol.Unregister, username, "all", ""))
+
+	// Create a SUB socket to receive messages from the central server
+	subscriber, _ := context.NewSocket(zmq.SUB)
+	curve.Apply(subscriber)
+	subscriber.Connect(fmt.Sprintf("tcp://%s:5556", *host))
+	subscriber.SetSubscribe("") // Subscribe to all messages
+
+	// Create a DEALER socket for private messages. Its identity is our
+	// username, so the broker routes messages for us to this socket only
+	dealer, _ := context.NewSocket(zmq.DEALER)
+	dealer.SetIdentity(username)
+	curve.Apply(dealer)
+	dealer.Connect(fmt.Sprintf("tcp://%s:5557", *host))
+
+	screen, err := tcell.NewScreen()
+	if err == nil {
+		err = screen.Init()
+	}
+	if err != nil {
+		fmt.Println("Failed to open the terminal:", err)
+		os.Exit(1)
+	}
+	defer screen.Fini()
+
+	u := &ui{
+		screen:   screen,
+		username: username,
+		users:    map[string]time.Time{username: time.Now()},
+	}
+	u.system(fmt.Sprintf("Welcome to the chat, %s! Type '@username message' to send a private message.", username))
+
+	// Private messages to send; the listener goroutine owns the dealer
+	private := make(chan *protocol.Message, 16)
+
+	// Messages for the screen. Only the main goroutine draws.
+	type delivery struct {
+		m       *protocol.Message
+		private bool
+	}
+	incoming := make(chan delivery, 64)
+
+	// Start listening for messages in a separate goroutine. It owns the
+	// subscriber and the dealer, and closes them when told we are done,
+	// before the context is terminated.
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	defer func() {
+		close(done)
+		<-stopped
+	}()
+	go func() {
+		defer close(stopped)
+		defer subscriber.Close()
+		defer dealer.Close()
+
+		poller := zmq.NewPoller()
+		poller.Add(subscriber, zmq.POLLIN)
+		poller.Add(dealer, zmq.POLLIN)
+
+		// The broker only routes to clients it has heard from recently, so
+		// say hello and keep beating
+		protocol.Send(dealer, protocol.New(protocol.Hello, username, "", ""))
+		lastBeat := time.Now()
+
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			if time.Since(lastBeat) >= heartbeatInterval {
+				protocol.Send(dealer, protocol.New(protocol.Heartbeat, username, "", ""))
+				lastBeat = time.Now()
+			}
+
+			// Send any private messages typed since the last poll
+			for flushed := false; !flushed; {
+				select {
+				case msg := <-private:
+					protocol.Send(dealer, msg)
+				default:
+					flushed = true
+				}
+			}
+
+			polled, err := poller.Poll(100 * time.Millisecond)
+			if err != nil {
+				continue
+			}
+
+			for _, item := range polled {
+				_, msg, err := protocol.Recv(item.Socket, 0)
+				if err != nil {
+					continue
+				}
+				select {
+				case incoming <- delivery{msg, item.Socket == dealer}:
+				case <-done:
+					return
+				}
+			}
+		}
+	}()
+
+	// Keyboard and resize events
+	events := make(chan tcell.Event, 16)
+	quit := make(chan struct{})
+	go screen.ChannelEvents(events, quit)
+	defer close(quit)
+
+	u.draw()
+	for {
+		select {
+		case d := <-incoming:
+			msg := d.m
+			if msg.Command == protocol.Unregister {
+				u.gone(msg.Sender)
+				break
+			}
+			u.seen(msg.Sender)
+			switch {
+			case msg.Command == protocol.System || msg.Command == protocol.Error:
+				u.system(msg.Body)
+			case d.private:
+				u.message(msg, username)
+			case msg.Target == "all":
+				u.message(msg, "")
+			}
+
+		case ev := <-events:
+			switch ev := ev.(type) {
+			case *tcell.EventResize:
+				screen.Sync()
+				u.scroll(0)
+
+			case *tcell.EventKey:
+				_, height := screen.Size()
+				switch ev.Key() {
+				case tcell.KeyCtrlC:
+					return
+				case tcell.KeyPgUp:
+					u.scroll(height - 3)
+				case tcell.KeyPgDn:
+					u.scroll(-(height - 3))
+				case tcell.KeyUp:
+					u.scroll(1)
+				case tcell.KeyDown:
+					u.scroll(-1)
+				case tcell.KeyEscape:
+					u.offset = 0
+				default:
+					message, done := u.edit(ev)
+					if !done || message == "" {
+						break
+					}
+					if message == "quit" {
+						return
+					}
+
+					// Check if message is private (@username message)
+					targetUser := "all"
+					if strings.HasPrefix(message, "@") {
+						words := strings.SplitN(message, " ", 2)
+						if len(words) == 2 {
+							targetUser = strings.TrimPrefix(words[0], "@")
+							message = words[1]
+						}
+					}
+
+					// Public messages come back from the broker; private
+					// ones are shown as we send them
+					msg := protocol.New(protocol.Msg, username, targetUser, message)
+					if targetUser == "all" {
+						protocol.Send(publisher, msg)
+					} else {
+						private <- msg
+						u.seen(targetUser)
+						u.message(msg, targetUser)
+					}
+					u.offset = 0
+				}
+			}
+		}
+		u.draw()
+	}
+}
@@ -0,0 +1,19 @@
+module github.com/maulikxg/ZeroMQ
+
+go 1.24.0
+
+require (
+	github.com/gdamore/tcell/v2 v2.8.1
+	github.com/mattn/go-runewidth v0.0.16
+	github.com/pebbe/zmq4 v1.2.11
+	golang.org/x/crypto v0.45.0
+)
+
+require (
+	github.com/gdamore/encoding v1.0.1 // indirect
+	github.com/lucasb-eyer/go-colorful v1.2.0 // indirect
+	github.com/rivo/uniseg v0.4.3 // indirect
+	golang.org/x/sys v0.38.0 // indirect
+	golang.org/x/term v0.37.0 // indirect
+	golang.org/x/text v0.31.0 // indirect
+)
@@ -0,0 +1,115 @@
+// Package bans keeps the broker's bans in a file, so they outlast
+// restarts. Users are banned by name, connections by peer address.
+package bans
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/maulikxg/ZeroMQ/test/chat/durable"
+)
+
+// Ban records who banned someone, why and when
+type Ban struct {
+	By     string    `json:"by"`
+	Reason string    `json:"reason,omitempty"`
+	Since  time.Time `json:"since"`
+}
+
+// List holds the bans in memory and writes every change through to its
+// file as JSON
+type List struct {
+	path  string
+	mutex sync.RWMutex
+
+	Users     map[string]Ban `json:"users"`
+	Addresses map[string]Ban `json:"addresses"`
+}
+
+// Open reads the ban list at path. A missing file is an empty list.
+func Open(path string) (*List, error) {
+	l := &List{
+		path:      path,
+		Users:     make(map[string]Ban),
+		Addresses: make(map[string]Ban),
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, l); err != nil {
+		return nil, err
+	}
+	if l.Users == nil {
+		l.Users = make(map[string]Ban)
+	}
+	if l.Addresses == nil {
+		l.Addresses = make(map[string]Ban)
+	}
+	return l, nil
+}
+
+// User reports whether username is banned
+func (l *List) User(username string) bool {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	_, ok := l.Users[username]
+	return ok
+}
+
+// Address reports whether connections from address are banned
+func (l *List) Address(address string) bool {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	_, ok := l.Addresses[address]
+	return ok
+}
+
+// BanUser bans username and saves the list
+func (l *List) BanUser(username, by, reason string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.Users[username] = Ban{By: by, Reason: reason, Since: time.Now()}
+	return l.save()
+}
+
+// BanAddress bans every connection from address and saves the list
+func (l *List) BanAddress(address, by, reason string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.Addresses[address] = Ban{By: by, Reason: reason, Since: time.Now()}
+	return l.save()
+}
+
+// Unban lifts the ban on a username or address and saves the list. It
+// reports false when neither was banned.
+func (l *List) Unban(target string) (bool, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	_, user := l.Users[target]
+	_, address := l.Addresses[target]
+	if !user && !address {
+		return false, nil
+	}
+	delete(l.Users, target)
+	delete(l.Addresses, target)
+	return true, l.save()
+}
+
+// save rewrites the whole file. A ban the broker reported as made is on
+// disk by then, so a restart cannot quietly lift it.
+func (l *List) save() error {
+	data, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return err
+	}
+	return durable.WriteFile(l.path, append(data, '\n'))
+}
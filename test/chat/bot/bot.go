@@ -0,0 +1,395 @@
+// Package bot runs chat bots against the broker in test/chat/cent.go.
+//
+// A bot implements Bot and hands it to Run, which registers the bot's
+// name, joins its rooms, keeps the session alive with heartbeats and takes
+// it back when the broker is lost. The hooks are called one at a time
+// from the runner's goroutine; they answer through the Session, which may
+// also be used from other goroutines, say by a bot that posts on a timer.
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/maulikxg/ZeroMQ/chat/keys"
+	"github.com/maulikxg/ZeroMQ/chat/protocol"
+	zmq "github.com/pebbe/zmq4"
+)
+
+// Bot reacts to what happens in its rooms
+type Bot interface {
+	// OnMessage is called for chat in the bot's rooms and for private
+	// messages to it, never for the bot's own messages
+	OnMessage(s *Session, m *protocol.Message)
+
+	// OnJoin and OnLeave are called when someone else joins or leaves
+	// one of the bot's rooms
+	OnJoin(s *Session, room, username string)
+	OnLeave(s *Session, room, username string)
+}
+
+// Config says where the bot connects and who it is
+type Config struct {
+	Host     string   // broker host name or address
+	Username string   // the bot's name
+	Rooms    []string // rooms to join besides the default one
+
+	BrokerKey string // broker.pub of a CURVE broker; plaintext if empty
+	ClientKey string // the bot's .secret key, for brokers that allow-list keys
+	Password  string // logs in with PLAIN when set
+}
+
+// Broker ports, as in test/chat/client.go
+const (
+	publishPort   = 5555
+	subscribePort = 5556
+	directPort    = 5557
+	controlPort   = 5558
+)
+
+// Heartbeats keep the bot's name; the broker answering them tells us it
+// is still there
+const (
+	heartbeatInterval = 5 * time.Second
+	brokerTimeout     = 3 * heartbeatInterval
+	controlTimeout    = 3 * time.Second
+	pollInterval      = 100 * time.Millisecond
+)
+
+// How long closing a socket may spend delivering what is still queued, so
+// stopping does not hang while the broker is away
+const closeLinger = time.Second
+
+// Delays between attempts to take the session back
+const (
+	initialBackoff = time.Second
+	maxBackoff     = 30 * time.Second
+)
+
+var (
+	ErrTaken  = errors.New("the bot's name is taken")
+	ErrBanned = errors.New("the bot is banned")
+	ErrKicked = errors.New("the bot was kicked")
+)
+
+// Session is a running bot's connection to the broker
+type Session struct {
+	config  Config
+	context *zmq.Context
+	curve   *keys.Client
+	token   string
+
+	// Messages from any goroutine, sent by the runner's goroutine, which
+	// owns the sockets. A hook that sends more than fit in the buffer
+	// blocks the runner for good, so hooks with a lot to say should say
+	// it from a goroutine of their own.
+	outgoing chan outgoing
+
+	mutex  sync.Mutex
+	joined map[string]bool
+}
+
+type outgoing struct {
+	m      *protocol.Message
+	direct bool
+}
+
+// Name is the bot's username
+func (s *Session) Name() string {
+	return s.config.Username
+}
+
+// Send sends text to a room ("#room") or a user
+func (s *Session) Send(target, text string) {
+	direct := !protocol.IsRoom(target)
+	s.outgoing <- outgoing{protocol.New(protocol.Msg, s.Name(), strings.TrimPrefix(target, "@"), text), direct}
+}
+
+// Reply answers m where it was said: in its room, or privately to its
+// sender
+func (s *Session) Reply(m *protocol.Message, text string) {
+	if protocol.IsRoom(m.Target) {
+		s.Send(m.Target, text)
+		return
+	}
+	s.Send(m.Sender, text)
+}
+
+// Join and Leave change the bot's rooms
+func (s *Session) Join(room string) {
+	s.outgoing <- outgoing{protocol.New(protocol.Join, s.Name(), "", room), false}
+}
+
+func (s *Session) Leave(room string) {
+	s.outgoing <- outgoing{protocol.New(protocol.Leave, s.Name(), "", room), false}
+}
+
+// socket creates a socket with the bot's encryption and credentials
+func (s *Session) socket(t zmq.Type, port int) (*zmq.Socket, error) {
+	socket, err := s.context.NewSocket(t)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.curve.Apply(socket); err != nil {
+		socket.Close()
+		return nil, err
+	}
+	socket.SetLinger(closeLinger)
+	if s.config.Password != "" {
+		socket.SetPlainUsername(s.config.Username)
+		socket.SetPlainPassword(s.config.Password)
+	}
+	if t == zmq.DEALER {
+		socket.SetIdentity(s.config.Username)
+	}
+	if err := socket.Connect(fmt.Sprintf("tcp://%s:%d", s.config.Host, port)); err != nil {
+		socket.Close()
+		return nil, err
+	}
+	return socket, nil
+}
+
+// control sends one request to the broker's control endpoint, on a fresh
+// REQ socket so a lost reply cannot wedge it
+func (s *Session) control(command, target, body string) (*protocol.Message, error) {
+	req, err := s.socket(zmq.REQ, controlPort)
+	if err != nil {
+		return nil, err
+	}
+	defer req.Close()
+
+	req.SetLinger(0)
+	req.SetSndtimeo(controlTimeout)
+	req.SetRcvtimeo(controlTimeout)
+	if err := protocol.Send(req, protocol.New(command, s.Name(), target, body)); err != nil {
+		return nil, err
+	}
+	_, reply, err := protocol.Recv(req, 0)
+	return reply, err
+}
+
+// replyError turns an ERR reply into an error
+func replyError(code string) error {
+	switch code {
+	case protocol.CodeTaken:
+		return ErrTaken
+	case protocol.CodeBanned:
+		return ErrBanned
+	default:
+		return fmt.Errorf("the broker refused: %s", code)
+	}
+}
+
+// roomList is the bot's rooms, comma separated for RESUME
+func (s *Session) roomList() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	rooms := make([]string, 0, len(s.joined))
+	for room := range s.joined {
+		rooms = append(rooms, room)
+	}
+	return strings.Join(rooms, ",")
+}
+
+// resume takes the session back after the broker was lost, retrying with
+// exponential backoff. It reports false if interrupt fired first.
+func (s *Session) resume(interrupt <-chan os.Signal) (bool, error) {
+	for delay := initialBackoff; ; delay = min(delay*2, maxBackoff) {
+		reply, err := s.control(protocol.Resume, s.roomList(), s.token)
+		if err == nil && reply.Command == protocol.OK {
+			return true, nil
+		}
+		if err == nil && (reply.Body == protocol.CodeTaken || reply.Body == protocol.CodeBanned) {
+			return false, replyError(reply.Body)
+		}
+		select {
+		case <-interrupt:
+			return false, nil
+		case <-time.After(delay):
+		}
+	}
+}
+
+// Run connects b to the broker and serves it until the bot is kicked,
+// banned or loses its name, or the process is interrupted, in which case
+// the bot signs off and Run returns nil
+func Run(config Config, b Bot) error {
+	if config.Host == "" {
+		config.Host = "localhost"
+	}
+	if !protocol.ValidUsername(config.Username) {
+		return fmt.Errorf("invalid bot name %q", config.Username)
+	}
+
+	s := &Session{
+		config:   config,
+		outgoing: make(chan outgoing, 64),
+		joined:   make(map[string]bool),
+	}
+
+	var err error
+	if config.BrokerKey != "" {
+		if config.ClientKey != "" {
+			s.curve, err = keys.LoadClient(config.BrokerKey, config.ClientKey)
+		} else {
+			s.curve, err = keys.NewClient(config.BrokerKey)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.context, err = zmq.NewContext(); err != nil {
+		return err
+	}
+	defer s.context.Term()
+
+	reply, err := s.control(protocol.Register, "", "")
+	if err != nil {
+		return fmt.Errorf("registering: %w", err)
+	}
+	if reply.Command != protocol.OK {
+		return replyError(reply.Body)
+	}
+	s.token = reply.Body
+
+	publisher, err := s.socket(zmq.PUB, publishPort)
+	if err != nil {
+		return err
+	}
+	defer publisher.Close()
+
+	subscriber, err := s.socket(zmq.SUB, subscribePort)
+	if err != nil {
+		return err
+	}
+	defer subscriber.Close()
+
+	dealer, err := s.socket(zmq.DEALER, directPort)
+	if err != nil {
+		return err
+	}
+	defer dealer.Close()
+
+	// HELLO puts us in the default room. The others are joined once the
+	// broker answers a heartbeat, as what we publish before our PUB has
+	// connected is lost.
+	protocol.Send(dealer, protocol.New(protocol.Hello, s.Name(), "", "ready"))
+	rooms := config.Rooms
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+
+	poller := zmq.NewPoller()
+	poller.Add(subscriber, zmq.POLLIN)
+	poller.Add(dealer, zmq.POLLIN)
+
+	lastBeat, lastSent := time.Now(), time.Time{}
+	for {
+		select {
+		case <-interrupt:
+			s.control(protocol.Unregister, "", s.token+" bot stopped")
+			return nil
+		default:
+		}
+
+		// Flush what the bot said since the last poll
+		for flushed := false; !flushed; {
+			select {
+			case out := <-s.outgoing:
+				if out.direct {
+					protocol.Send(dealer, out.m)
+				} else {
+					protocol.Send(publisher, out.m)
+				}
+			default:
+				flushed = true
+			}
+		}
+
+		lost := time.Since(lastBeat) > brokerTimeout
+		if time.Since(lastSent) >= heartbeatInterval && !lost {
+			protocol.Send(publisher, protocol.New(protocol.Heartbeat, s.Name(), "", "alive"))
+			lastSent = time.Now()
+		}
+		if lost {
+			// The broker is gone, so there is nobody to sign off from
+			resumed, err := s.resume(interrupt)
+			if !resumed {
+				return err
+			}
+			protocol.Send(dealer, protocol.New(protocol.Hello, s.Name(), "", "ready"))
+			lastBeat = time.Now()
+		}
+
+		polled, err := poller.Poll(pollInterval)
+		if err != nil {
+			continue
+		}
+		for _, item := range polled {
+			// Room traffic carries a topic frame, direct traffic does not
+			prefixLen := 0
+			if item.Socket == subscriber {
+				prefixLen = 1
+			}
+			_, m, err := protocol.Recv(item.Socket, prefixLen)
+			if err != nil {
+				continue
+			}
+
+			switch m.Command {
+			case protocol.Heartbeat:
+				lastBeat = time.Now()
+				if m.Body == protocol.SessionUnknown {
+					// Resume at the top of the loop
+					lastBeat = time.Time{}
+					continue
+				}
+				// Straight onto the socket: the outgoing queue is only
+				// drained by this goroutine and may not fit every room
+				for _, room := range rooms {
+					protocol.Send(publisher, protocol.New(protocol.Join, s.Name(), "", room))
+				}
+				rooms = nil
+
+			case protocol.JoinOK:
+				s.mutex.Lock()
+				s.joined[m.Body] = true
+				s.mutex.Unlock()
+				subscriber.SetSubscribe(protocol.RoomTopic(m.Body))
+
+			case protocol.LeaveOK:
+				s.mutex.Lock()
+				delete(s.joined, m.Body)
+				s.mutex.Unlock()
+				subscriber.SetUnsubscribe(protocol.RoomTopic(m.Body))
+
+			case protocol.Kicked:
+				return fmt.Errorf("%w: %s", ErrKicked, m.Body)
+
+			case protocol.Joined, protocol.Left:
+				if m.Sender == s.Name() {
+					continue
+				}
+				room := strings.TrimPrefix(m.Target, "#")
+				if m.Command == protocol.Joined {
+					b.OnJoin(s, room, m.Sender)
+				} else {
+					b.OnLeave(s, room, m.Sender)
+				}
+
+			case protocol.Msg:
+				if m.Sender != s.Name() {
+					b.OnMessage(s, m)
+				}
+			}
+		}
+	}
+}
@@ -2,94 +2,1938 @@
 package main
 
 import (
+    "crypto/rand"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "flag"
     "fmt"
+    "log"
+    "net"
+    "sort"
+    "strconv"
     "strings"
     "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/maulikxg/ZeroMQ/chat/auth"
+    "github.com/maulikxg/ZeroMQ/chat/keys"
+    "github.com/maulikxg/ZeroMQ/chat/protocol"
+    "github.com/maulikxg/ZeroMQ/test/chat/bans"
+    "github.com/maulikxg/ZeroMQ/test/chat/e2e"
+    "github.com/maulikxg/ZeroMQ/test/chat/history"
+    "github.com/maulikxg/ZeroMQ/test/chat/limit"
+    "github.com/maulikxg/ZeroMQ/test/chat/mailbox"
+    "github.com/maulikxg/ZeroMQ/test/chat/transfer"
     zmq "github.com/pebbe/zmq4"
 )
 
-type Broker struct {
-    usernames map[string]bool
-    mutex     sync.RWMutex
+// Every user is placed in this room on registration
+const defaultRoom = "general"
+
+// Upper bound for a single HISTORY request
+const maxHistory = 500
+
+// Rooms a resumed session the broker had forgotten may ask to join again
+const maxRejoin = 32
+
+// validRoomName allows short names made of lowercase letters, digits,
+// '-' and '_' so room names can never collide with the topic syntax
+func validRoomName(room string) bool {
+    if room == "" || len(room) > 32 {
+        return false
+    }
+    for _, r := range room {
+        if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+            return false
+        }
+    }
+    return true
+}
+
+// How long an offered file waits for an answer, an accepted transfer for
+// its next frame, and a finished one is kept to answer the sender in case
+// the final ACK was lost on its way
+const (
+    offerTimeout    = 5 * time.Minute
+    transferTimeout = time.Minute
+    finishedTimeout = 30 * time.Second
+)
+
+// fileTransfer is a file offered by one user to another. Once it is
+// accepted the broker relays data channel frames between the two.
+type fileTransfer struct {
+    from, to   string
+    name       string
+    size       int64
+    accepted   bool
+    finished   bool
+    lastActive time.Time
+}
+
+// Chat messages the broker remembers for edits, deletes and replies;
+// older ones can no longer be changed or answered
+const recentMessages = 10000
+
+// chatRecord is what the broker remembers of a chat message to check
+// changes and replies against
+type chatRecord struct {
+    author  string
+    target  string // "#room" or the recipient
+    deleted bool
+}
+
+// How long a kicked user has to wait before taking their name back
+const kickCooldown = time.Minute
+
+// Penalties for a client whose message was rejected
+const (
+    penaltyDrop = "drop" // discard it silently
+    penaltyWarn = "warn" // discard it and tell the sender once
+    penaltyMute = "mute" // discard it and mute the sender for a while
+)
+
+// Reasons for rejecting a message, also the names of their counters
+const (
+    rejectSize     = "too-large"
+    rejectConnRate = "connection-rate"
+    rejectUserRate = "user-rate"
+    rejectMuted    = "muted"
+)
+
+// Guard keeps one client from drowning everyone else: it enforces the
+// message size limit, rate limits per username and per peer address, and
+// mutes, and counts what it rejects
+type Guard struct {
+    users      *limit.Limiter
+    conns      *limit.Limiter
+    maxMessage int
+    penalty    string
+    muteFor    time.Duration
+
+    mutex    sync.Mutex
+    muted    map[string]time.Time // username -> end of mute
+    warned   map[string]bool      // told about a rejection since their last accepted message
+    rejected map[string]uint64    // reason -> count
+}
+
+func NewGuard(users, conns *limit.Limiter, maxMessage int, penalty string, muteFor time.Duration) *Guard {
+    return &Guard{
+        users:      users,
+        conns:      conns,
+        maxMessage: maxMessage,
+        penalty:    penalty,
+        muteFor:    muteFor,
+        muted:      make(map[string]time.Time),
+        warned:     make(map[string]bool),
+        rejected:   make(map[string]uint64),
+    }
+}
+
+// allowConnection applies the per-address limit alone, for requests that
+// do not come from a registered user
+func (g *Guard) allowConnection(address string) bool {
+    if g.conns.Allow(address) {
+        return true
+    }
+    g.count(rejectConnRate)
+    return false
+}
+
+// check returns why a message of size bytes from address should be
+// rejected, or "" to accept it. Heartbeats only count against the
+// address so a muted user is not reaped as well.
+func (g *Guard) check(address string, m *protocol.Message, size int) string {
+    reason := ""
+    switch {
+    case size > g.maxMessage:
+        reason = rejectSize
+    case !g.conns.Allow(address):
+        reason = rejectConnRate
+    case m.Command == protocol.Heartbeat:
+    case (m.Command == protocol.Msg || m.Command == protocol.Edit) && g.isMuted(m.Sender):
+        reason = rejectMuted
+    case !g.users.Allow(m.Sender):
+        reason = rejectUserRate
+    }
+
+    if reason != "" {
+        g.count(reason)
+    } else if m.Command != protocol.Heartbeat {
+        g.mutex.Lock()
+        delete(g.warned, m.Sender)
+        g.mutex.Unlock()
+    }
+    return reason
+}
+
+func (g *Guard) count(reason string) {
+    g.mutex.Lock()
+    defer g.mutex.Unlock()
+    g.rejected[reason]++
+}
+
+func (g *Guard) isMuted(username string) bool {
+    g.mutex.Lock()
+    defer g.mutex.Unlock()
+
+    until, ok := g.muted[username]
+    if ok && time.Now().After(until) {
+        delete(g.muted, username)
+        return false
+    }
+    return ok
+}
+
+// rename carries a mute over to a user's new name, so /nick is no way
+// out of one
+func (g *Guard) rename(from, to string) {
+    g.mutex.Lock()
+    defer g.mutex.Unlock()
+
+    if until, ok := g.muted[from]; ok {
+        delete(g.muted, from)
+        g.muted[to] = until
+    }
+}
+
+// mute silences username for d, by the penalty or by an admin
+func (g *Guard) mute(username string, d time.Duration) {
+    g.mutex.Lock()
+    defer g.mutex.Unlock()
+    g.muted[username] = time.Now().Add(d)
+}
+
+// warnOnce reports whether username still has to be told about a
+// rejection, so a flood is not answered with a flood of warnings
+func (g *Guard) warnOnce(username string) bool {
+    g.mutex.Lock()
+    defer g.mutex.Unlock()
+
+    if g.warned[username] {
+        return false
+    }
+    g.warned[username] = true
+    return true
+}
+
+// describe explains a rejection to the sender
+func (g *Guard) describe(reason string) string {
+    switch reason {
+    case rejectSize:
+        return fmt.Sprintf("message dropped: larger than %d bytes", g.maxMessage)
+    case rejectMuted:
+        return "message dropped: you are muted"
+    default:
+        return "message dropped: you are sending too fast"
+    }
+}
+
+// summary formats the rejection counters and their total
+func (g *Guard) summary() (string, uint64) {
+    g.mutex.Lock()
+    defer g.mutex.Unlock()
+
+    var total uint64
+    parts := make([]string, 0, len(g.rejected))
+    for reason, n := range g.rejected {
+        parts = append(parts, fmt.Sprintf("%s=%d", reason, n))
+        total += n
+    }
+    sort.Strings(parts)
+    return strings.Join(parts, " "), total
+}
+
+// maintain periodically logs the rejection counters when they changed and
+// forgets idle rate limit buckets
+func (g *Guard) maintain(interval time.Duration) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    var reported uint64
+    for range ticker.C {
+        g.users.Prune()
+        g.conns.Prune()
+
+        if counters, total := g.summary(); total != reported {
+            log.Printf("Rejected messages: %s", counters)
+            reported = total
+        }
+    }
+}
+
+type Broker struct {
+    usernames map[string]bool
+    lastSeen  map[string]time.Time
+    rooms     map[string]map[string]bool // room -> members
+    sessions  map[string]string          // username -> session token
+    rejoin    map[string][]string        // username -> rooms to join at their next HELLO
+    keys      map[string]string          // username -> end-to-end public key
+    away      map[string]string          // username -> away message
+    mutex     sync.RWMutex
+
+    // The sockets belong to the main loop; nothing else may send on them
+    publisher *zmq.Socket
+
+    // router reaches a single client by its DEALER identity, which is
+    // its username. Users are only routable after their HELLO.
+    router    *zmq.Socket
+    connected map[string]bool
+
+    // Room messages are logged so late joiners and restarts keep context
+    history *history.Log
+    replay  int
+
+    // Direct messages for users who are offline wait here. They go to
+    // whoever next signs in under the name, so only authentication keeps
+    // them private.
+    mailbox *mailbox.Store
+
+    // With authentication on, a connection may only speak as the user
+    // the ZAP handler authenticated it as
+    authRequired bool
+
+    // Flood protection for everything clients send
+    guard *Guard
+
+    // Moderation. Admins may kick, ban and mute; bans are kept on disk,
+    // kicks only hold a name back for kickCooldown. The address of each
+    // user's direct channel lets admins ban where a user connects from.
+    admins    map[string]bool
+    bans      *bans.List
+    kicked    map[string]time.Time
+    addresses map[string]string // username -> peer address
+
+    // Message IDs are the broker's start time followed by a counter, so
+    // they stay unique across restarts that keep the history
+    epoch  string
+    lastID atomic.Uint64
+
+    // Recent chat messages by ID, and their IDs oldest first
+    recent      map[string]*chatRecord
+    recentOrder []string
+    recentMutex sync.Mutex
+
+    // Files being offered or relayed, by transfer ID. The data socket is
+    // only used by the main loop.
+    transfers     map[string]*fileTransfer
+    transferMutex sync.Mutex
+    data          *zmq.Socket
+}
+
+func NewBroker(publisher, router *zmq.Socket, messageLog *history.Log, replay int, queue *mailbox.Store) *Broker {
+    return &Broker{
+        usernames: make(map[string]bool),
+        connected: make(map[string]bool),
+        lastSeen:  make(map[string]time.Time),
+        away:      make(map[string]string),
+        sessions:  make(map[string]string),
+        rejoin:    make(map[string][]string),
+        keys:      make(map[string]string),
+        rooms: map[string]map[string]bool{
+            defaultRoom: make(map[string]bool),
+        },
+        publisher: publisher,
+        router:    router,
+        history:   messageLog,
+        replay:    replay,
+        mailbox:   queue,
+        epoch:     strconv.FormatInt(time.Now().Unix(), 36),
+        transfers: make(map[string]*fileTransfer),
+        admins:    make(map[string]bool),
+        kicked:    make(map[string]time.Time),
+        addresses: make(map[string]string),
+        recent:    make(map[string]*chatRecord),
+    }
+}
+
+// stamp gives an accepted message its broker ID and time and returns the
+// reference the client had put in the ID field
+func (b *Broker) stamp(m *protocol.Message) string {
+    ref := m.ID
+    m.ID = fmt.Sprintf("%s-%d", b.epoch, b.lastID.Add(1))
+    m.Time = time.Now()
+    return ref
+}
+
+// remember records a stamped chat message so it can be changed and
+// answered later
+func (b *Broker) remember(m *protocol.Message) {
+    b.recentMutex.Lock()
+    defer b.recentMutex.Unlock()
+
+    b.recent[m.ID] = &chatRecord{author: m.Sender, target: m.Target}
+    b.recentOrder = append(b.recentOrder, m.ID)
+    if len(b.recentOrder) > recentMessages {
+        delete(b.recent, b.recentOrder[0])
+        b.recentOrder = b.recentOrder[1:]
+    }
+}
+
+// checkReply reports whether m may be sent: it is not a reply, or it
+// answers a message said in the same room or conversation
+func (b *Broker) checkReply(m *protocol.Message) bool {
+    parent, _, ok := protocol.IsReply(m.Body)
+    if !ok {
+        return true
+    }
+
+    b.recentMutex.Lock()
+    record, found := b.recent[parent]
+    valid := found && !record.deleted &&
+        (record.target == m.Target ||
+            record.author == m.Target && record.target == m.Sender)
+    b.recentMutex.Unlock()
+
+    if !valid {
+        b.notify(m.Sender, fmt.Sprintf("there is no message %s here to reply to", parent))
+    }
+    return valid
+}
+
+// checkReceipt reports whether m acknowledges a private message its
+// sender was sent by its target, so nobody can fake receipts for messages
+// that were not theirs
+func (b *Broker) checkReceipt(m *protocol.Message) bool {
+    b.recentMutex.Lock()
+    defer b.recentMutex.Unlock()
+    record, found := b.recent[m.ID]
+    return found && record.target == m.Sender && record.author == m.Target
+}
+
+// handleChange applies an EDIT or DELETE of the message with ID m.ID and
+// passes it on wherever the message went
+func (b *Broker) handleChange(m *protocol.Message) {
+    username := m.Sender
+    if m.Command == protocol.Edit && strings.TrimSpace(m.Body) == "" {
+        b.notify(username, "an edit needs the new text; delete the message instead")
+        return
+    }
+    admin := b.isAdmin(username)
+
+    b.recentMutex.Lock()
+    record, found := b.recent[m.ID]
+    if !found || record.deleted {
+        b.recentMutex.Unlock()
+        b.notify(username, fmt.Sprintf("there is no message %s to change", m.ID))
+        return
+    }
+    if record.author != username && !admin {
+        b.recentMutex.Unlock()
+        b.notify(username, "only the author of a message or an admin can change it")
+        return
+    }
+    if m.Command == protocol.Delete {
+        record.deleted = true
+    }
+    author, target := record.author, record.target
+    b.recentMutex.Unlock()
+
+    change := protocol.New(m.Command, username, target, "")
+    change.ID = m.ID
+    if m.Command == protocol.Edit {
+        change.Body = m.Body
+    }
+
+    if protocol.IsRoom(target) {
+        // Logged, so replayed history shows the change as well
+        room := strings.TrimPrefix(target, "#")
+        b.publish(protocol.RoomTopic(room), change)
+        line, _ := json.Marshal(change)
+        if err := b.history.Append(room, string(line)); err != nil {
+            log.Printf("Failed to log message for #%s: %v", room, err)
+        }
+        return
+    }
+
+    // Both ends of the conversation, including whoever made the change
+    for _, user := range []string{author, target} {
+        b.deliverOrQueue(user, change)
+    }
+}
+
+// deliverOrQueue sends m to username, or quietly queues it for them when
+// they are offline
+func (b *Broker) deliverOrQueue(username string, m *protocol.Message) {
+    if b.isConnected(username) && b.direct(username, m) {
+        return
+    }
+    line, _ := json.Marshal(m)
+    if err := b.mailbox.Put(username, string(line)); err != nil && !errors.Is(err, mailbox.ErrFull) {
+        log.Printf("Failed to queue a message for %s: %v", username, err)
+    }
+}
+
+// acknowledge tells the author of m that the broker accepted it
+func (b *Broker) acknowledge(m *protocol.Message, ref string) {
+    ack := protocol.New(protocol.Ack, "", m.Target, ref)
+    ack.ID = m.ID
+    b.direct(m.Sender, ack)
+}
+
+func (b *Broker) publish(topic string, m *protocol.Message) {
+    protocol.Send(b.publisher, m, topic)
+}
+
+// direct sends m to exactly one user over the ROUTER socket and reports
+// whether it could be routed. With mandatory routing a send to a client
+// whose queue is full would block the whole broker, so such a client is
+// treated like one that is not connected.
+func (b *Broker) direct(username string, m *protocol.Message) bool {
+    return protocol.SendDontwait(b.router, m, username) == nil
+}
+
+// notify sends a SYSTEM line to a single user
+func (b *Broker) notify(username, text string) {
+    b.direct(username, protocol.New(protocol.System, "", username, text))
+}
+
+// announce sends a SYSTEM line to everyone in a room
+func (b *Broker) announce(room, text string) {
+    b.publish(protocol.RoomTopic(room), protocol.New(protocol.System, "", "#"+room, text))
+}
+
+// membership publishes a JOINED or LEFT event for username in room
+func (b *Broker) membership(command, username, room string) {
+    b.publish(protocol.RoomTopic(room), protocol.New(command, username, "#"+room, ""))
+}
+
+// checkUsername registers a free name and returns its new session token,
+// or an error code
+func (b *Broker) checkUsername(username string) (string, string) {
+    b.mutex.Lock()
+    defer b.mutex.Unlock()
+
+    if b.barredLocked(username) {
+        return "", protocol.CodeBanned
+    }
+    if _, exists := b.usernames[username]; exists {
+        return "", protocol.CodeTaken
+    }
+
+    token := newToken()
+    b.usernames[username] = true
+    b.lastSeen[username] = time.Now()
+    b.sessions[username] = token
+    return token, ""
+}
+
+// newToken returns a random session token
+func newToken() string {
+    token := make([]byte, 16)
+    rand.Read(token)
+    return hex.EncodeToString(token)
+}
+
+// resume gives a user whose connection dropped their session back. A
+// registered name needs the session's token and keeps the rooms the
+// broker has for it. A name the broker does not know, say after a
+// restart, is registered again with the token, and joins the rooms the
+// client lists at its HELLO, as if it had asked, so members see it come
+// back. It returns an error code, or "" on success.
+func (b *Broker) resume(username, token string, rooms []string) string {
+    b.mutex.Lock()
+    defer b.mutex.Unlock()
+
+    if b.barredLocked(username) {
+        return protocol.CodeBanned
+    }
+    if b.usernames[username] {
+        if b.sessions[username] != token {
+            return protocol.CodeTaken
+        }
+    } else {
+        b.usernames[username] = true
+        b.sessions[username] = token
+        b.rejoin[username] = rooms[:min(len(rooms), maxRejoin)]
+    }
+    b.lastSeen[username] = time.Now()
+    delete(b.connected, username)
+    return ""
+}
+
+// takeRejoin returns and forgets the rooms a resumed user is to join
+func (b *Broker) takeRejoin(username string) []string {
+    b.mutex.Lock()
+    defer b.mutex.Unlock()
+    rooms := b.rejoin[username]
+    delete(b.rejoin, username)
+    return rooms
+}
+
+// owns reports whether token is the session token username was given
+func (b *Broker) owns(username, token string) bool {
+    b.mutex.Lock()
+    defer b.mutex.Unlock()
+    session, ok := b.sessions[username]
+    return ok && session == token
+}
+
+// removeUsername forgets a user and returns the rooms they were in
+func (b *Broker) removeUsername(username string) []string {
+    b.mutex.Lock()
+    defer b.mutex.Unlock()
+    return b.removeLocked(username)
+}
+
+func (b *Broker) removeLocked(username string) []string {
+    delete(b.usernames, username)
+    delete(b.lastSeen, username)
+    delete(b.connected, username)
+    delete(b.away, username)
+    delete(b.sessions, username)
+    delete(b.rejoin, username)
+    delete(b.addresses, username)
+
+    var left []string
+    for room, members := range b.rooms {
+        if members[username] {
+            b.leaveLocked(username, room)
+            left = append(left, room)
+        }
+    }
+    return left
+}
+
+// touch records activity from a registered user and reports whether the
+// user is still known to the broker
+func (b *Broker) touch(username string) bool {
+    b.mutex.Lock()
+    defer b.mutex.Unlock()
+
+    if _, exists := b.usernames[username]; !exists {
+        return false
+    }
+
+    b.lastSeen[username] = time.Now()
+    return true
+}
+
+// expireUsers removes every user not heard from within timeout and
+// returns the rooms each of them was in
+func (b *Broker) expireUsers(timeout time.Duration) map[string][]string {
+    b.mutex.Lock()
+    defer b.mutex.Unlock()
+
+    expired := make(map[string][]string)
+    now := time.Now()
+    for username, seen := range b.lastSeen {
+        if now.Sub(seen) > timeout {
+            expired[username] = b.removeLocked(username)
+        }
+    }
+    return expired
+}
+
+// reapStaleUsers drops users whose client stopped sending heartbeats
+// (crashed, killed, lost network) so their names are freed. The main
+// loop calls it between polls, since it sends on the broker's sockets.
+func (b *Broker) reapStaleUsers(timeout time.Duration) {
+    for username, rooms := range b.expireUsers(timeout) {
+        fmt.Printf("No heartbeat from %s for %v, removing\n", username, timeout)
+        for _, room := range rooms {
+            b.announce(room, fmt.Sprintf("%s has left the chat", username))
+            b.membership(protocol.Left, username, room)
+        }
+    }
+    b.expireTransfers()
+}
+
+// expireTransfers forgets offers nobody answered and transfers that
+// went quiet, telling both users
+func (b *Broker) expireTransfers() {
+    b.transferMutex.Lock()
+    var expired []*fileTransfer
+    for id, t := range b.transfers {
+        limit := offerTimeout
+        switch {
+        case t.finished:
+            limit = finishedTimeout
+        case t.accepted:
+            limit = transferTimeout
+        }
+        if time.Since(t.lastActive) > limit {
+            delete(b.transfers, id)
+            if !t.finished {
+                expired = append(expired, t)
+            }
+        }
+    }
+    b.transferMutex.Unlock()
+
+    for _, t := range expired {
+        text := fmt.Sprintf("transfer of %s from %s to %s expired", t.name, t.from, t.to)
+        b.notify(t.from, text)
+        b.notify(t.to, text)
+    }
+}
+
+// offerFile records a file offer and passes it on to its recipient
+func (b *Broker) offerFile(m *protocol.Message) {
+    size, name, ok := protocol.ParseOffer(m.Body)
+    if !ok {
+        b.direct(m.Sender, protocol.New(protocol.Error, "", m.Sender, "usage: OFFER <size> <name>"))
+        return
+    }
+    if m.Target == m.Sender {
+        b.notify(m.Sender, "you cannot send a file to yourself")
+        return
+    }
+    if !b.isConnected(m.Target) {
+        b.notify(m.Sender, fmt.Sprintf("%s is not online", m.Target))
+        return
+    }
+
+    ref := b.stamp(m)
+    b.transferMutex.Lock()
+    b.transfers[m.ID] = &fileTransfer{from: m.Sender, to: m.Target, name: name, size: size, lastActive: time.Now()}
+    b.transferMutex.Unlock()
+
+    if !b.direct(m.Target, m) {
+        b.endTransfer(m.ID)
+        b.notify(m.Sender, fmt.Sprintf("%s is not online", m.Target))
+        return
+    }
+    b.acknowledge(m, ref)
+}
+
+// answerOffer handles the recipient's ACCEPT or DECLINE of an offer
+func (b *Broker) answerOffer(identity string, m *protocol.Message) {
+    b.transferMutex.Lock()
+    t, ok := b.transfers[m.ID]
+    valid := ok && t.to == identity && !t.accepted
+    if valid {
+        if m.Command == protocol.Accept {
+            t.accepted = true
+            t.lastActive = time.Now()
+        } else {
+            delete(b.transfers, m.ID)
+        }
+    }
+    b.transferMutex.Unlock()
+
+    if !valid {
+        b.notify(identity, fmt.Sprintf("there is no open offer %s for you", m.ID))
+        return
+    }
+    m.Target = t.from
+    if !b.direct(t.from, m) {
+        b.endTransfer(m.ID)
+        b.notify(identity, fmt.Sprintf("%s is no longer online", t.from))
+    }
+}
+
+func (b *Broker) endTransfer(id string) {
+    b.transferMutex.Lock()
+    defer b.transferMutex.Unlock()
+    delete(b.transfers, id)
+}
+
+// relayData passes a data channel frame from one side of an accepted
+// transfer to the other. Frames for unknown transfers are answered with
+// an ABORT so the client stops waiting.
+func (b *Broker) relayData(identity, userID string, frames []string) {
+    f, err := transfer.Decode(frames)
+    if err != nil {
+        return
+    }
+    username, id, ok := transfer.ParseIdentity(identity)
+    if !ok || id != f.ID || !b.authorized(userID, username) {
+        return
+    }
+
+    b.transferMutex.Lock()
+    t, ok := b.transfers[id]
+    if ok && t.finished {
+        b.transferMutex.Unlock()
+        // The sender is still resending, so it missed the final ACK
+        if username == t.from && f.Kind == transfer.Data {
+            ack := &transfer.Frame{ID: id, Kind: transfer.Ack, Offset: t.size}
+            b.data.SendMessageDontwait(ack.Parts(identity)...)
+        }
+        return
+    }
+    peer := ""
+    if ok && t.accepted {
+        switch username {
+        case t.from:
+            peer = t.to
+        case t.to:
+            peer = t.from
+        }
+    }
+    if peer != "" {
+        t.lastActive = time.Now()
+        // Either side giving up ends the transfer. The receiver
+        // acknowledging every byte finishes it, but it is kept a while
+        // for the sender's retries should that ACK not get through.
+        switch {
+        case f.Kind == transfer.Abort:
+            delete(b.transfers, id)
+        case f.Kind == transfer.Ack && f.Offset == t.size:
+            t.finished = true
+        }
+    }
+    b.transferMutex.Unlock()
+
+    if peer == "" {
+        abort := &transfer.Frame{ID: id, Kind: transfer.Abort, Payload: "unknown transfer"}
+        b.data.SendMessageDontwait(abort.Parts(identity)...)
+        return
+    }
+    // Mandatory routing drops frames for a side that is not connected
+    // yet or has a full queue; the clients resend until it gets through
+    b.data.SendMessageDontwait(f.Parts(transfer.Identity(peer, id))...)
+}
+
+// joinRoom adds a registered user to a room, creating it if needed.
+// It reports false if the user was already a member.
+func (b *Broker) joinRoom(username, room string) bool {
+    b.mutex.Lock()
+    defer b.mutex.Unlock()
+
+    members, exists := b.rooms[room]
+    if !exists {
+        members = make(map[string]bool)
+        b.rooms[room] = members
+    }
+    if members[username] {
+        return false
+    }
+    members[username] = true
+    return true
+}
+
+// leaveRoom removes a user from a room and reports whether they were in it
+func (b *Broker) leaveRoom(username, room string) bool {
+    b.mutex.Lock()
+    defer b.mutex.Unlock()
+
+    if !b.rooms[room][username] {
+        return false
+    }
+    b.leaveLocked(username, room)
+    return true
+}
+
+func (b *Broker) leaveLocked(username, room string) {
+    delete(b.rooms[room], username)
+    if len(b.rooms[room]) == 0 && room != defaultRoom {
+        delete(b.rooms, room)
+    }
+}
+
+func (b *Broker) inRoom(username, room string) bool {
+    b.mutex.RLock()
+    defer b.mutex.RUnlock()
+    return b.rooms[room][username]
+}
+
+// connect marks a registered user's direct channel as ready. It reports
+// false for unknown users and repeated HELLOs.
+func (b *Broker) connect(username string) bool {
+    b.mutex.Lock()
+    defer b.mutex.Unlock()
+
+    if !b.usernames[username] || b.connected[username] {
+        return false
+    }
+    b.connected[username] = true
+    b.lastSeen[username] = time.Now()
+    return true
+}
+
+func (b *Broker) isRegistered(username string) bool {
+    b.mutex.RLock()
+    defer b.mutex.RUnlock()
+    return b.usernames[username]
+}
+
+// whois describes a registered user's activity and rooms
+func (b *Broker) whois(username string) (string, bool) {
+    b.mutex.RLock()
+    defer b.mutex.RUnlock()
+
+    if !b.usernames[username] {
+        return "", false
+    }
+
+    var rooms []string
+    for room, members := range b.rooms {
+        if members[username] {
+            rooms = append(rooms, "#"+room)
+        }
+    }
+    sort.Strings(rooms)
+
+    idle := time.Since(b.lastSeen[username]).Round(time.Second)
+    info := fmt.Sprintf("%s is online, idle %v, in %s", username, idle, strings.Join(rooms, ", "))
+    if away, ok := b.away[username]; ok {
+        info += "; away: " + away
+    }
+    return info, true
+}
+
+// listUsers returns every registered user, one per line, followed by a
+// tab and their away message if they set one
+func (b *Broker) listUsers() string {
+    b.mutex.RLock()
+    defer b.mutex.RUnlock()
+
+    names := make([]string, 0, len(b.usernames))
+    for username := range b.usernames {
+        if away, ok := b.away[username]; ok {
+            username += "\t" + away
+        }
+        names = append(names, username)
+    }
+    sort.Strings(names)
+    return strings.Join(names, "\n")
+}
+
+// setAway marks a user away with a message, or back when it is empty
+func (b *Broker) setAway(username, message string) {
+    b.mutex.Lock()
+    defer b.mutex.Unlock()
+
+    if message == "" {
+        delete(b.away, username)
+    } else {
+        b.away[username] = message
+    }
+}
+
+func (b *Broker) awayMessage(username string) (string, bool) {
+    b.mutex.RLock()
+    defer b.mutex.RUnlock()
+    message, ok := b.away[username]
+    return message, ok
+}
+
+// rename moves a user and their rooms to a new name. The direct channel
+// is keyed by the old name, so the user has to say HELLO again. It
+// returns the user's rooms, or an error code.
+func (b *Broker) rename(from, to string) ([]string, string) {
+    b.mutex.Lock()
+    defer b.mutex.Unlock()
+
+    if !b.usernames[from] {
+        return nil, protocol.CodeUnknownUser
+    }
+    if b.barredLocked(to) {
+        return nil, protocol.CodeBanned
+    }
+    if b.usernames[to] {
+        return nil, protocol.CodeTaken
+    }
+
+    delete(b.usernames, from)
+    b.usernames[to] = true
+    b.lastSeen[to] = time.Now()
+    delete(b.lastSeen, from)
+    delete(b.connected, from)
+    if away, ok := b.away[from]; ok {
+        b.away[to] = away
+        delete(b.away, from)
+    }
+    b.sessions[to] = b.sessions[from]
+    delete(b.sessions, from)
+    if address, ok := b.addresses[from]; ok {
+        b.addresses[to] = address
+        delete(b.addresses, from)
+    }
+    if key, ok := b.keys[from]; ok {
+        b.keys[to] = key
+        delete(b.keys, from)
+    }
+
+    var rooms []string
+    for room, members := range b.rooms {
+        if members[from] {
+            delete(members, from)
+            members[to] = true
+            rooms = append(rooms, room)
+        }
+    }
+    sort.Strings(rooms)
+    return rooms, ""
+}
+
+func (b *Broker) isConnected(username string) bool {
+    b.mutex.RLock()
+    defer b.mutex.RUnlock()
+    return b.connected[username]
+}
+
+// listRooms describes every room and its member count
+func (b *Broker) listRooms() string {
+    b.mutex.RLock()
+    defer b.mutex.RUnlock()
+
+    names := make([]string, 0, len(b.rooms))
+    for room := range b.rooms {
+        names = append(names, room)
+    }
+    sort.Strings(names)
+
+    for i, room := range names {
+        names[i] = fmt.Sprintf("#%s (%d)", room, len(b.rooms[room]))
+    }
+    return strings.Join(names, ", ")
+}
+
+// roomsOf lists the rooms a user is in
+func (b *Broker) roomsOf(username string) []string {
+    b.mutex.RLock()
+    defer b.mutex.RUnlock()
+
+    var rooms []string
+    for room, members := range b.rooms {
+        if members[username] {
+            rooms = append(rooms, room)
+        }
+    }
+    sort.Strings(rooms)
+    return rooms
 }
 
-func NewBroker() *Broker {
-    return &Broker{
-        usernames: make(map[string]bool),
+// replayHistory sends the last n messages of room to one user only
+func (b *Broker) replayHistory(username, room string, n int) {
+    entries, err := b.history.Last(room, n)
+    if err != nil {
+        log.Printf("Failed to read history for #%s: %v", room, err)
+        b.notify(username, fmt.Sprintf("history for #%s is unavailable", room))
+        return
+    }
+
+    var messages []protocol.Message
+    deleted := make(map[string]bool)
+    for _, entry := range entries {
+        var m protocol.Message
+        if err := json.Unmarshal([]byte(entry.Message), &m); err != nil {
+            continue
+        }
+        if m.Command == protocol.Delete {
+            deleted[m.ID] = true
+        }
+        messages = append(messages, m)
+    }
+
+    // Edits follow the messages they change, as they happened. Deleted
+    // messages are replayed without their text, followed by the DELETE.
+    for _, m := range messages {
+        switch m.Command {
+        case protocol.Msg:
+            m.Command = protocol.History
+            if deleted[m.ID] {
+                m.Body = ""
+            }
+        case protocol.Edit:
+            if deleted[m.ID] {
+                continue
+            }
+        }
+        b.direct(username, &m)
+    }
+}
+
+// queueDirect stores a direct message for a user who is offline and tells
+// the sender
+func (b *Broker) queueDirect(m *protocol.Message, ref string) {
+    if !protocol.ValidUsername(m.Target) {
+        b.notify(m.Sender, fmt.Sprintf("%q is not a valid username", m.Target))
+        return
+    }
+
+    line, _ := json.Marshal(m)
+    err := b.mailbox.Put(m.Target, string(line))
+    if errors.Is(err, mailbox.ErrFull) {
+        b.notify(m.Sender, fmt.Sprintf("%s is offline and has too many messages waiting; yours was not queued", m.Target))
+        return
+    }
+    if err != nil {
+        log.Printf("Failed to queue a message for %s: %v", m.Target, err)
+        b.notify(m.Sender, fmt.Sprintf("%s is not online", m.Target))
+        return
+    }
+
+    b.acknowledge(m, ref)
+    b.notify(m.Sender, fmt.Sprintf("%s is offline; your message was queued and will be delivered when they sign in", m.Target))
+}
+
+// deliverQueued sends a user the direct messages queued while they were
+// offline, oldest first. Whatever cannot be sent stays queued.
+func (b *Broker) deliverQueued(username string) {
+    queued, err := b.mailbox.Pending(username)
+    if err != nil {
+        log.Printf("Failed to read queued messages for %s: %v", username, err)
+        return
+    }
+    if len(queued) == 0 {
+        return
+    }
+
+    b.notify(username, fmt.Sprintf("%d direct messages arrived while you were away", len(queued)))
+    var undelivered []string
+    for i, line := range queued {
+        var m protocol.Message
+        if err := json.Unmarshal([]byte(line), &m); err != nil {
+            continue
+        }
+        if !b.direct(username, &m) {
+            undelivered = queued[i:]
+            break
+        }
+    }
+    if err := b.mailbox.Keep(username, undelivered); err != nil {
+        log.Printf("Failed to update queued messages for %s: %v", username, err)
+    }
+}
+
+// barredLocked reports whether username is banned or was kicked too
+// recently to come back
+func (b *Broker) barredLocked(username string) bool {
+    if b.bans.User(username) {
+        return true
+    }
+    if when, ok := b.kicked[username]; ok {
+        if time.Since(when) < kickCooldown {
+            return true
+        }
+        delete(b.kicked, username)
     }
+    return false
 }
 
-func (b *Broker) checkUsername(username string) bool {
+// setKey publishes a registered user's end-to-end public key. Keys are
+// kept after their users leave, so messages queued for them while they
+// are offline can be encrypted too.
+func (b *Broker) setKey(username, key string) bool {
     b.mutex.Lock()
     defer b.mutex.Unlock()
-    
-    if _, exists := b.usernames[username]; exists {
+
+    if !b.usernames[username] {
         return false
     }
-    
-    b.usernames[username] = true
+    b.keys[username] = key
     return true
 }
 
-func (b *Broker) removeUsername(username string) {
+func (b *Broker) keyOf(username string) (string, bool) {
+    b.mutex.RLock()
+    defer b.mutex.RUnlock()
+    key, ok := b.keys[username]
+    return key, ok
+}
+
+// isAdmin reports whether username is a signed-in admin. The admin list
+// is fixed at startup.
+func (b *Broker) isAdmin(username string) bool {
+    b.mutex.RLock()
+    defer b.mutex.RUnlock()
+    return b.admins[username] && b.usernames[username]
+}
+
+// observe records the peer address a registered user's direct channel
+// connects from
+func (b *Broker) observe(username, address string) {
     b.mutex.Lock()
     defer b.mutex.Unlock()
-    delete(b.usernames, username)
+
+    if b.usernames[username] && address != "" {
+        b.addresses[username] = address
+    }
+}
+
+func (b *Broker) addressOf(username string) string {
+    b.mutex.RLock()
+    defer b.mutex.RUnlock()
+    return b.addresses[username]
+}
+
+// usersAt lists the users connected from address
+func (b *Broker) usersAt(address string) []string {
+    b.mutex.RLock()
+    defer b.mutex.RUnlock()
+
+    var users []string
+    for username, at := range b.addresses {
+        if at == address {
+            users = append(users, username)
+        }
+    }
+    sort.Strings(users)
+    return users
+}
+
+// kick disconnects a user, tells them why, keeps their name from them for
+// kickCooldown and announces it in the rooms they were in
+func (b *Broker) kick(username, text string) {
+    b.direct(username, protocol.New(protocol.Kicked, "", username, text))
+
+    b.mutex.Lock()
+    b.kicked[username] = time.Now()
+    rooms := b.removeLocked(username)
+    b.mutex.Unlock()
+
+    for _, room := range rooms {
+        b.announce(room, text)
+        b.membership(protocol.Left, username, room)
+    }
+    fmt.Println(text)
+}
+
+// moderation describes an admin's action for the notices about it
+func moderation(target, action, admin, reason string) string {
+    text := fmt.Sprintf("%s was %s by %s", target, action, admin)
+    if reason != "" {
+        text += ": " + reason
+    }
+    return text
+}
+
+// handleModeration carries out an admin's KICK, BAN, UNBAN or MUTE
+func (b *Broker) handleModeration(m *protocol.Message) *protocol.Message {
+    admin, target := m.Sender, m.Target
+    token, reason, _ := strings.Cut(m.Body, " ")
+    reason = strings.TrimSpace(reason)
+    reply := func(command, body string) *protocol.Message {
+        return protocol.New(command, "", admin, body)
+    }
+
+    // The sender frame is only a claim; the token proves it. Admins
+    // cannot act on each other, so no one admin can lock out the rest.
+    if !b.isAdmin(admin) || !b.owns(admin, token) || b.admins[target] {
+        return reply(protocol.Err, protocol.CodeForbidden)
+    }
+
+    switch m.Command {
+    case protocol.Kick:
+        if !b.isRegistered(target) {
+            return reply(protocol.Err, protocol.CodeUnknownUser)
+        }
+        b.kick(target, moderation(target, "kicked", admin, reason))
+        return reply(protocol.OK, "kicked "+target)
+
+    case protocol.Ban:
+        // Anything that parses as an IP address is a peer address
+        if net.ParseIP(target) != nil {
+            users := b.usersAt(target)
+            for _, username := range users {
+                if b.admins[username] {
+                    return reply(protocol.Err, protocol.CodeForbidden)
+                }
+            }
+            if err := b.bans.BanAddress(target, admin, reason); err != nil {
+                log.Printf("Failed to save the ban list: %v", err)
+            }
+            for _, username := range users {
+                b.kick(username, moderation(username, "banned", admin, reason))
+            }
+            return reply(protocol.OK, fmt.Sprintf("banned %s, %d users disconnected", target, len(users)))
+        }
+
+        if !protocol.ValidUsername(target) {
+            return reply(protocol.Err, protocol.CodeInvalidName)
+        }
+        if err := b.bans.BanUser(target, admin, reason); err != nil {
+            log.Printf("Failed to save the ban list: %v", err)
+        }
+        text := moderation(target, "banned", admin, reason)
+        if b.isRegistered(target) {
+            b.kick(target, text)
+        } else {
+            b.announce(defaultRoom, text)
+        }
+        return reply(protocol.OK, "banned "+target)
+
+    case protocol.Unban:
+        lifted, err := b.bans.Unban(target)
+        if err != nil {
+            log.Printf("Failed to save the ban list: %v", err)
+        }
+        b.mutex.Lock()
+        _, wasKicked := b.kicked[target]
+        delete(b.kicked, target)
+        b.mutex.Unlock()
+
+        if !lifted && !wasKicked {
+            return reply(protocol.Err, protocol.CodeUnknownUser)
+        }
+        b.announce(defaultRoom, moderation(target, "unbanned", admin, reason))
+        return reply(protocol.OK, "unbanned "+target)
+
+    case protocol.Mute:
+        durationText, why, _ := strings.Cut(reason, " ")
+        d, err := time.ParseDuration(durationText)
+        if err != nil || d <= 0 {
+            return reply(protocol.Err, protocol.CodeBadRequest)
+        }
+        if !b.isRegistered(target) {
+            return reply(protocol.Err, protocol.CodeUnknownUser)
+        }
+        b.guard.mute(target, d)
+
+        text := moderation(target, "muted for "+d.String(), admin, strings.TrimSpace(why))
+        rooms := b.roomsOf(target)
+        for _, room := range rooms {
+            b.announce(room, text)
+        }
+        if len(rooms) == 0 {
+            b.notify(target, text)
+        }
+        return reply(protocol.OK, "muted "+target)
+
+    default:
+        return reply(protocol.Err, protocol.CodeBadRequest)
+    }
+}
+
+func (b *Broker) handleHistory(username, arg string) {
+    n, err := strconv.Atoi(strings.TrimSpace(arg))
+    if err != nil || n <= 0 {
+        b.notify(username, "usage: HISTORY <n>")
+        return
+    }
+    if n > maxHistory {
+        n = maxHistory
+    }
+
+    for _, room := range b.roomsOf(username) {
+        b.replayHistory(username, room, n)
+    }
+}
+
+func (b *Broker) handleJoin(username, room string) {
+    room = strings.ToLower(strings.TrimPrefix(room, "#"))
+    if !validRoomName(room) {
+        b.direct(username, protocol.New(protocol.JoinFail, "", username, room))
+        b.notify(username, "room names may only contain a-z, 0-9, '-' and '_'")
+        return
+    }
+    if !b.joinRoom(username, room) {
+        b.notify(username, fmt.Sprintf("you are already in #%s", room))
+        return
+    }
+
+    // Tell the client first so it subscribes before the announcement
+    b.direct(username, protocol.New(protocol.JoinOK, "", username, room))
+    b.replayHistory(username, room, b.replay)
+    b.announce(room, fmt.Sprintf("%s joined #%s", username, room))
+    b.membership(protocol.Joined, username, room)
+}
+
+func (b *Broker) handleLeave(username, room string) {
+    room = strings.ToLower(strings.TrimPrefix(room, "#"))
+    if !b.leaveRoom(username, room) {
+        b.notify(username, fmt.Sprintf("you are not in #%s", room))
+        return
+    }
+
+    b.direct(username, protocol.New(protocol.LeaveOK, "", username, room))
+    b.announce(room, fmt.Sprintf("%s left #%s", username, room))
+    b.membership(protocol.Left, username, room)
+}
+
+// handlePublished processes a message sent on the clients' PUB sockets:
+// heartbeats, room commands and room chat
+func (b *Broker) handlePublished(m *protocol.Message) {
+    username := m.Sender
+
+    switch m.Command {
+    case protocol.Heartbeat:
+        // Answered on the direct channel so the client knows we are
+        // alive, and whether we still know it
+        status := protocol.SessionOK
+        if !b.touch(username) {
+            status = protocol.SessionUnknown
+        }
+        b.direct(username, protocol.New(protocol.Heartbeat, "", username, status))
+
+    case protocol.Join:
+        if b.touch(username) {
+            b.handleJoin(username, m.Body)
+        }
+
+    case protocol.Leave:
+        if b.touch(username) {
+            b.handleLeave(username, m.Body)
+        }
+
+    case protocol.History:
+        if b.touch(username) {
+            b.handleHistory(username, m.Body)
+        }
+
+    case protocol.Rooms:
+        if b.touch(username) {
+            b.notify(username, "Rooms: "+b.listRooms())
+        }
+
+    case protocol.Away:
+        if !b.touch(username) {
+            return
+        }
+        b.setAway(username, m.Body)
+        if m.Body == "" {
+            b.notify(username, "you are no longer marked away")
+        } else {
+            b.notify(username, "you are marked away: "+m.Body)
+        }
+
+    case protocol.Msg:
+        if !b.touch(username) {
+            return
+        }
+
+        if !protocol.IsRoom(m.Target) {
+            // Private messages never travel over PUB/SUB
+            b.notify(username, "private messages must be sent on the direct channel")
+            return
+        }
+
+        room := strings.TrimPrefix(m.Target, "#")
+        if !b.inRoom(username, room) {
+            b.notify(username, fmt.Sprintf("you are not in #%s", room))
+            return
+        }
+        if !b.checkReply(m) {
+            return
+        }
+        ref := b.stamp(m)
+        b.remember(m)
+        b.publish(protocol.RoomTopic(room), m)
+
+        line, _ := json.Marshal(m)
+        if err := b.history.Append(room, string(line)); err != nil {
+            log.Printf("Failed to log message for #%s: %v", room, err)
+        }
+        b.acknowledge(m, ref)
+
+    case protocol.Edit, protocol.Delete:
+        // Anyone can publish under any name, so changes come only on the
+        // direct channel
+        if b.touch(username) {
+            b.notify(username, "changes to messages must be sent on the direct channel")
+        }
+
+    default:
+        if b.isConnected(username) {
+            b.direct(username, protocol.New(protocol.Error, "", username, "unknown command "+m.Command))
+        }
+    }
+}
+
+// handleDirect processes a message from a client's DEALER socket. The
+// identity frame is set by ZeroMQ, so senders cannot pose as someone else.
+func (b *Broker) handleDirect(identity string, m *protocol.Message) {
+    if m.Command == protocol.Hello {
+        if m.Sender == identity && b.connect(identity) {
+            for _, room := range b.takeRejoin(identity) {
+                b.handleJoin(identity, room)
+            }
+            // A user saying HELLO again after /nick keeps their rooms
+            if len(b.roomsOf(identity)) == 0 {
+                b.handleJoin(identity, defaultRoom)
+            }
+            b.deliverQueued(identity)
+        }
+        return
+    }
+
+    if m.Sender != identity || !b.isConnected(identity) {
+        b.direct(identity, protocol.New(protocol.Error, "", identity, "say HELLO as yourself first"))
+        return
+    }
+
+    switch m.Command {
+    case protocol.Msg:
+        b.touch(identity)
+        if !b.checkReply(m) {
+            return
+        }
+        ref := b.stamp(m)
+        b.remember(m)
+        if !b.isConnected(m.Target) || !b.direct(m.Target, m) {
+            b.queueDirect(m, ref)
+            return
+        }
+        b.acknowledge(m, ref)
+        if away, ok := b.awayMessage(m.Target); ok {
+            b.notify(identity, fmt.Sprintf("%s is away: %s", m.Target, away))
+        }
+
+    case protocol.Edit, protocol.Delete:
+        b.touch(identity)
+        b.handleChange(m)
+
+    case protocol.Offer:
+        b.touch(identity)
+        b.offerFile(m)
+
+    case protocol.Accept, protocol.Decline:
+        b.touch(identity)
+        b.answerOffer(identity, m)
+
+    case protocol.Delivered, protocol.Read:
+        // Receipts are best effort: a sender who has gone away since
+        // simply never sees them
+        if b.checkReceipt(m) && b.isConnected(m.Target) {
+            b.direct(m.Target, m)
+        }
+
+    default:
+        b.direct(identity, protocol.New(protocol.Error, "", identity, "only private messages, changes to messages, receipts and file offers are accepted here"))
+    }
+}
+
+// handleControl answers a request from a client's control REQ socket
+func (b *Broker) handleControl(m *protocol.Message) *protocol.Message {
+    username := m.Sender
+    reply := func(command, body string) *protocol.Message {
+        return protocol.New(command, "", username, body)
+    }
+
+    switch m.Command {
+    case protocol.Register:
+        if !protocol.ValidUsername(username) {
+            return reply(protocol.Err, protocol.CodeInvalidName)
+        }
+        token, code := b.checkUsername(username)
+        if code != "" {
+            return reply(protocol.Err, code)
+        }
+        // The client says HELLO on its direct channel next and is placed
+        // in the default room then, and gets any queued messages
+        return reply(protocol.OK, token)
+
+    case protocol.Resume:
+        // The body is the session token, the target the rooms to be put
+        // back in, comma separated
+        if !protocol.ValidUsername(username) || m.Body == "" {
+            return reply(protocol.Err, protocol.CodeBadRequest)
+        }
+        var rooms []string
+        if m.Target != "" {
+            rooms = strings.Split(m.Target, ",")
+        }
+        if code := b.resume(username, m.Body, rooms); code != "" {
+            return reply(protocol.Err, code)
+        }
+        fmt.Printf("%s resumed their session\n", username)
+        return reply(protocol.OK, m.Body)
+
+    case protocol.Unregister:
+        if !b.isRegistered(username) {
+            return reply(protocol.Err, protocol.CodeUnknownUser)
+        }
+        token, reason, _ := strings.Cut(m.Body, " ")
+        if !b.owns(username, token) {
+            return reply(protocol.Err, protocol.CodeForbidden)
+        }
+        text := fmt.Sprintf("%s has left the chat", username)
+        if reason != "" {
+            text += " (" + reason + ")"
+        }
+        for _, room := range b.removeUsername(username) {
+            b.announce(room, text)
+            b.membership(protocol.Left, username, room)
+        }
+        return reply(protocol.OK, "unregistered")
+
+    case protocol.List:
+        return reply(protocol.OK, b.listUsers())
+
+    case protocol.Nick:
+        // Credentials belong to a name, so authenticated users keep theirs
+        if b.authRequired {
+            return reply(protocol.Err, protocol.CodeForbidden)
+        }
+        if !b.owns(username, m.Body) {
+            return reply(protocol.Err, protocol.CodeForbidden)
+        }
+        if !protocol.ValidUsername(m.Target) {
+            return reply(protocol.Err, protocol.CodeInvalidName)
+        }
+        rooms, code := b.rename(username, m.Target)
+        if code != "" {
+            return reply(protocol.Err, code)
+        }
+        b.guard.rename(username, m.Target)
+        for _, room := range rooms {
+            b.announce(room, fmt.Sprintf("%s is now known as %s", username, m.Target))
+            b.membership(protocol.Left, username, room)
+            b.membership(protocol.Joined, m.Target, room)
+        }
+        return protocol.New(protocol.OK, "", m.Target, "renamed")
+
+    case protocol.Whois:
+        info, ok := b.whois(m.Target)
+        if !ok {
+            return reply(protocol.Err, protocol.CodeUnknownUser)
+        }
+        // Admins see where users connect from, to ban an address
+        if address := b.addressOf(m.Target); address != "" && b.isAdmin(username) {
+            info += "; connected from " + address
+        }
+        return reply(protocol.OK, info)
+
+    case protocol.Kick, protocol.Ban, protocol.Unban, protocol.Mute:
+        return b.handleModeration(m)
+
+    case protocol.SetKey:
+        // Only the key's form is checked; clients pin keys and warn when
+        // one changes, as the broker is not trusted with them. The token
+        // keeps others from replacing it.
+        token, key, _ := strings.Cut(m.Body, " ")
+        if _, err := e2e.ParseKey(key); err != nil {
+            return reply(protocol.Err, protocol.CodeBadRequest)
+        }
+        if !b.isRegistered(username) {
+            return reply(protocol.Err, protocol.CodeUnknownUser)
+        }
+        if !b.owns(username, token) {
+            return reply(protocol.Err, protocol.CodeForbidden)
+        }
+        if !b.setKey(username, key) {
+            return reply(protocol.Err, protocol.CodeUnknownUser)
+        }
+        return reply(protocol.OK, "key published")
+
+    case protocol.GetKey:
+        key, ok := b.keyOf(m.Target)
+        if !ok {
+            return reply(protocol.Err, protocol.CodeUnknownUser)
+        }
+        return reply(protocol.OK, key)
+
+    default:
+        return reply(protocol.Err, protocol.CodeBadRequest)
+    }
+}
+
+// admit runs a message from address through the guard and applies the
+// configured penalty when it is rejected
+func (b *Broker) admit(address string, m *protocol.Message, size int) bool {
+    reason := b.guard.check(address, m, size)
+    if reason == "" {
+        return true
+    }
+    if !b.isConnected(m.Sender) {
+        return false
+    }
+
+    switch b.guard.penalty {
+    case penaltyWarn:
+        if b.guard.warnOnce(m.Sender) {
+            b.notify(m.Sender, b.guard.describe(reason))
+        }
+
+    case penaltyMute:
+        if reason != rejectMuted {
+            b.guard.mute(m.Sender, b.guard.muteFor)
+            b.notify(m.Sender, fmt.Sprintf("%s; muted for %v", b.guard.describe(reason), b.guard.muteFor))
+        } else if b.guard.warnOnce(m.Sender) {
+            b.notify(m.Sender, b.guard.describe(reason))
+        }
+    }
+    return false
+}
+
+// frameBytes is the size of a multipart message on the wire, near enough
+func frameBytes(frames []string) int {
+    size := 0
+    for _, frame := range frames {
+        size += len(frame)
+    }
+    return size
+}
+
+// authorized reports whether a connection authenticated as userID may
+// act as username
+func (b *Broker) authorized(userID, username string) bool {
+    return !b.authRequired || userID == username
+}
+
+// rejectMalformed answers an undecodable message with an ERROR reply when
+// its author can be told apart
+func (b *Broker) rejectMalformed(frames []string, userID string, err error) {
+    author := userID
+    if !b.authRequired && len(frames) > 2 {
+        // Best effort on PUB/SUB: the sender frame sits at index 2 in
+        // every version so far
+        author = frames[2]
+    }
+    if b.isConnected(author) {
+        b.direct(author, protocol.New(protocol.Error, "", author, err.Error()))
+    }
+}
+
+// receive reads one multipart message along with the ZAP User-Id ("" when
+// authentication is off) and peer address of the connection it arrived on
+func receive(socket *zmq.Socket) (frames []string, userID, address string, err error) {
+    frames, metadata, err := socket.RecvMessageWithMetadata(0, "User-Id", "Peer-Address")
+    return frames, metadata["User-Id"], metadata["Peer-Address"], err
 }
 
 func main() {
+    timeout := flag.Duration("timeout", 15*time.Second, "drop users not heard from for this long")
+    reapInterval := flag.Duration("reap-interval", 5*time.Second, "how often to look for stale users")
+    historyDir := flag.String("history-dir", "chat_history", "directory for the per-room message logs")
+    historyMaxBytes := flag.Int64("history-max-bytes", 1<<20, "compact a room log once it grows past this size")
+    historyKeep := flag.Int("history-keep", 1000, "messages kept per room when a log is compacted")
+    replay := flag.Int("replay", 20, "messages replayed to a user joining a room")
+    mailboxDir := flag.String("mailbox-dir", "chat_mailbox", "directory for direct messages waiting for offline users")
+    mailboxSize := flag.Int("mailbox-size", 100, "direct messages queued per offline user")
+    keyDir := flag.String("keys", "", "directory with broker.pub and broker.secret; enables CURVE encryption")
+    credentialsFile := flag.String("credentials", "", "username/password-hash file; enables PLAIN authentication")
+    allowFile := flag.String("allow", "", "username/public-key allow-list; enables CURVE client authentication (needs -keys)")
+    userRate := flag.Float64("user-rate", 5, "messages per second allowed per username; 0 disables")
+    userBurst := flag.Int("user-burst", 10, "messages a username may send at once before -user-rate applies")
+    connRate := flag.Float64("conn-rate", 50, "messages per second allowed per peer address; 0 disables")
+    connBurst := flag.Int("conn-burst", 100, "messages a peer address may send at once before -conn-rate applies")
+    maxMessage := flag.Int("max-message", 64<<10, "largest message accepted, in bytes")
+    penalty := flag.String("penalty", penaltyWarn, "what happens to a client whose message is rejected: drop, warn or mute")
+    muteFor := flag.Duration("mute-for", 30*time.Second, "how long -penalty mute silences a client")
+    statsInterval := flag.Duration("stats-interval", time.Minute, "how often to log rejected message counts")
+    adminList := flag.String("admins", "", "comma-separated usernames, or public keys from -allow, of users who may kick, ban and mute")
+    bansFile := flag.String("bans", "chat_bans.json", "file the ban list is kept in")
+    flag.Parse()
+
+    switch *penalty {
+    case penaltyDrop, penaltyWarn, penaltyMute:
+    default:
+        log.Fatalf("Unknown -penalty %q, want drop, warn or mute", *penalty)
+    }
+
+    if *credentialsFile != "" && (*keyDir != "" || *allowFile != "") {
+        log.Fatal("Use -credentials on its own, or -keys with -allow")
+    }
+    if *allowFile != "" && *keyDir == "" {
+        log.Fatal("-allow needs -keys")
+    }
+
+    messageLog, err := history.Open(*historyDir, *historyMaxBytes, *historyKeep)
+    if err != nil {
+        log.Fatal("Failed to open history directory:", err)
+    }
+    queue, err := mailbox.Open(*mailboxDir, *mailboxSize)
+    if err != nil {
+        log.Fatal("Failed to open mailbox directory:", err)
+    }
+    banList, err := bans.Open(*bansFile)
+    if err != nil {
+        log.Fatal("Failed to load the ban list:", err)
+    }
+
+    // Without keys the broker speaks plaintext and should stay on localhost
+    var curve *keys.Server
+    if *keyDir != "" {
+        if curve, err = keys.LoadServer(*keyDir); err != nil {
+            log.Fatal("Failed to load broker keys:", err)
+        }
+        fmt.Println("CURVE enabled, broker public key:", curve.Public)
+    }
+
+    // Load whoever may log in; with neither file anyone can register
+    var handler *auth.Handler
+    var clientKeys map[string]string // public key -> username
+    switch {
+    case *credentialsFile != "":
+        credentials, err := auth.LoadCredentials(*credentialsFile)
+        if err != nil {
+            log.Fatal("Failed to load credentials:", err)
+        }
+        handler = auth.NewHandler(credentials, nil)
+        fmt.Printf("PLAIN authentication enabled for %d users\n", len(credentials))
+        // ZeroMQ cannot run PLAIN inside CURVE, hence -credentials on its own
+        log.Print("WARNING: PLAIN sends passwords unencrypted; use -credentials only on a trusted network, or -keys with -allow anywhere else")
+
+    case *allowFile != "":
+        clientKeys, err = auth.LoadAllowList(*allowFile)
+        if err != nil {
+            log.Fatal("Failed to load allow-list:", err)
+        }
+        handler = auth.NewHandler(nil, clientKeys)
+        fmt.Printf("CURVE client authentication enabled for %d keys\n", len(clientKeys))
+    }
+
     context, _ := zmq.NewContext()
     defer context.Term()
 
-    broker := NewBroker()
+    // The ZAP handler has to be bound before any client connects
+    if handler != nil {
+        zap, _ := context.NewSocket(zmq.REP)
+        defer zap.Close()
+        if err := zap.Bind(auth.Endpoint); err != nil {
+            log.Fatal("Failed to bind ZAP handler:", err)
+        }
+        go handler.Serve(zap)
+    }
+
+    // secure applies encryption, authentication and the message size
+    // limit to a server socket. ZeroMQ disconnects peers that send a
+    // larger frame, before it is ever buffered.
+    secure := func(socket *zmq.Socket) {
+        curve.Apply(socket)
+        socket.SetMaxmsgsize(int64(*maxMessage))
+        if *credentialsFile != "" {
+            socket.SetPlainServer(1)
+        }
+        if handler != nil {
+            socket.SetZapDomain(auth.Domain)
+        }
+    }
 
     // Socket for publishing messages
     publisher, _ := context.NewSocket(zmq.PUB)
     defer publisher.Close()
+    secure(publisher)
     publisher.Bind("tcp://*:5556")
 
     // Socket for receiving messages
     subscriber, _ := context.NewSocket(zmq.SUB)
     defer subscriber.Close()
+    secure(subscriber)
     subscriber.Bind("tcp://*:5555")
     subscriber.SetSubscribe("")
 
+    // Socket for traffic meant for one client only. Mandatory routing
+    // makes sends to unknown identities fail instead of vanishing.
+    router, _ := context.NewSocket(zmq.ROUTER)
+    defer router.Close()
+    router.SetRouterMandatory(1)
+    secure(router)
+    router.Bind("tcp://*:5557")
+
+    // Socket for register/unregister/whois requests from REQ clients,
+    // kept apart from the chat data path
+    control, _ := context.NewSocket(zmq.ROUTER)
+    defer control.Close()
+    secure(control)
+    control.Bind("tcp://*:5558")
+
+    // Socket relaying file transfers, away from the chat traffic. Its
+    // frames may be as large as a transfer chunk whatever -max-message is.
+    data, _ := context.NewSocket(zmq.ROUTER)
+    defer data.Close()
+    data.SetRouterMandatory(1)
+    secure(data)
+    data.SetMaxmsgsize(transfer.ChunkSize)
+    data.Bind("tcp://*:5559")
+
+    broker := NewBroker(publisher, router, messageLog, *replay, queue)
+    broker.authRequired = handler != nil
+    broker.data = data
+    broker.guard = NewGuard(limit.New(*userRate, *userBurst), limit.New(*connRate, *connBurst), *maxMessage, *penalty, *muteFor)
+    go broker.guard.maintain(*statsInterval)
+
+    // Admins are named by username, or by their key in the allow-list
+    broker.bans = banList
+    for _, admin := range strings.Split(*adminList, ",") {
+        admin = strings.TrimSpace(admin)
+        if username, ok := clientKeys[admin]; ok {
+            admin = username
+        }
+        if admin != "" {
+            broker.admins[admin] = true
+        }
+    }
+    if len(broker.admins) > 0 && handler == nil {
+        log.Print("Warning: without -credentials or -allow, admin names are not authenticated; whoever registers one first, say while its admin is offline, can kick, ban and mute")
+    }
+
+    poller := zmq.NewPoller()
+    poller.Add(subscriber, zmq.POLLIN)
+    poller.Add(router, zmq.POLLIN)
+    poller.Add(control, zmq.POLLIN)
+    poller.Add(data, zmq.POLLIN)
+
     fmt.Println("Central broker running...")
 
+    // Users that stop sending heartbeats are expired between polls
+    nextReap := time.Now().Add(*reapInterval)
+
     for {
-        // Receive message
-        message, err := subscriber.Recv(0)
+        polled, err := poller.Poll(max(time.Until(nextReap), 0))
+        if !time.Now().Before(nextReap) {
+            broker.reapStaleUsers(*timeout)
+            nextReap = time.Now().Add(*reapInterval)
+        }
         if err != nil {
             continue
         }
 
-        parts := strings.SplitN(message, ":", 3)
-        if len(parts) < 2 {
-            continue
-        }
+        for _, item := range polled {
+            switch item.Socket {
+            case subscriber:
+                frames, userID, address, err := receive(subscriber)
+                if err != nil || banList.Address(address) {
+                    continue
+                }
+                m, err := protocol.Decode(frames)
+                if err != nil {
+                    broker.rejectMalformed(frames, userID, err)
+                    continue
+                }
+                if !broker.authorized(userID, m.Sender) {
+                    broker.notify(userID, fmt.Sprintf("you are logged in as %s, not %s", userID, m.Sender))
+                    continue
+                }
+                if broker.admit(address, m, frameBytes(frames)) {
+                    broker.handlePublished(m)
+                }
 
-        command := parts[0]
-        username := parts[1]
+            case router:
+                frames, userID, address, err := receive(router)
+                if err != nil || len(frames) < 1 || banList.Address(address) {
+                    continue
+                }
+                identity := frames[0]
 
-        switch command {
-        case "REGISTER":
-            if broker.checkUsername(username) {
-                // Username is available
-                publisher.Send(fmt.Sprintf("REGISTER_OK:%s:success", username), 0)
-            } else {
-                // Username is taken
-                publisher.Send(fmt.Sprintf("REGISTER_FAIL:%s:taken", username), 0)
-            }
+                // The DEALER identity is chosen by the client, so it has
+                // to match the authenticated user as well
+                if !broker.authorized(userID, identity) {
+                    continue
+                }
+                m, err := protocol.Decode(frames[1:])
+                if err != nil {
+                    broker.direct(identity, protocol.New(protocol.Error, "", identity, err.Error()))
+                    continue
+                }
+                if broker.admit(address, m, frameBytes(frames[1:])) {
+                    broker.observe(identity, address)
+                    broker.handleDirect(identity, m)
+                }
 
-        case "UNREGISTER":
-            broker.removeUsername(username)
-            publisher.Send(fmt.Sprintf("SYSTEM:all:%s has left the chat", username), 0)
+            case control:
+                // REQ envelopes are [identity, empty delimiter, message]
+                frames, userID, address, err := receive(control)
+                if err != nil || len(frames) < 2 {
+                    continue
+                }
+                reply := protocol.New(protocol.Err, "", "", protocol.CodeBadRequest)
+                if banList.Address(address) {
+                    reply = protocol.New(protocol.Err, "", "", protocol.CodeBanned)
+                } else if !broker.guard.allowConnection(address) {
+                    reply = protocol.New(protocol.Err, "", "", protocol.CodeRateLimited)
+                } else if m, err := protocol.Decode(frames[2:]); err == nil {
+                    if broker.authorized(userID, m.Sender) {
+                        reply = broker.handleControl(m)
+                    } else {
+                        reply = protocol.New(protocol.Err, "", m.Sender, protocol.CodeForbidden)
+                    }
+                }
+                protocol.Send(control, reply, frames[:2]...)
 
-        default:
-            // Regular chat message, forward it
-            if len(parts) == 3 {
-                publisher.Send(message, 0)
+            case data:
+                frames, userID, address, err := receive(data)
+                if err != nil || len(frames) < 1 || banList.Address(address) {
+                    continue
+                }
+                broker.relayData(frames[0], userID, frames[1:])
             }
         }
     }
-}
\ No newline at end of file
+}
@@ -3,35 +3,745 @@ package main
 
 import (
     "bufio"
+    "flag"
     "fmt"
     "os"
+    "path/filepath"
+    "sort"
+    "strconv"
     "strings"
+    "sync"
+    "sync/atomic"
     "time"
+
+    "github.com/maulikxg/ZeroMQ/chat/keys"
+    "github.com/maulikxg/ZeroMQ/chat/protocol"
+    "github.com/maulikxg/ZeroMQ/test/chat/e2e"
+    "github.com/maulikxg/ZeroMQ/test/chat/transfer"
     zmq "github.com/pebbe/zmq4"
 )
 
+// How often the client tells the broker it is still alive
+const heartbeatInterval = 5 * time.Second
+
+// The broker answers every heartbeat; after this long without an answer
+// we take it to be gone
+const brokerTimeout = 3 * heartbeatInterval
+
+// Delays between attempts to take our session back, doubling up to the
+// maximum
+const (
+    initialBackoff = time.Second
+    maxBackoff     = 30 * time.Second
+)
+
+// Room the broker puts every user in on registration
+const defaultRoom = "general"
+
+// How long the receiver waits on its sockets before checking for
+// outgoing private messages
+const pollInterval = 100 * time.Millisecond
+
+// Broker ports: we publish to its SUB, read its PUB, talk privately to
+// its ROUTER, send register/unregister/whois to its control socket and
+// stream files through its data socket
+const (
+    publishPort   = 5555
+    subscribePort = 5556
+    directPort    = 5557
+    controlPort   = 5558
+    dataPort      = 5559
+)
+
+// How long to wait for the broker to answer a control request
+const controlTimeout = 3 * time.Second
+
+// How long closing a socket may spend delivering what is still queued, so
+// quitting does not hang while the broker is away
+const closeLinger = time.Second
+
+// How many of our own messages keep their delivery status
+const outboxSize = 100
+
+// How many chat messages we keep for /reply, /edit, /delete and /thread
+const keptMessages = 500
+
+// Replies are indented this much deeper than what they answer, up to
+// maxDepth levels
+const (
+    indent   = "  "
+    maxDepth = 8
+)
+
+var (
+    brokerHost = flag.String("host", "localhost", "broker host name or address")
+    brokerKey  = flag.String("broker-key", "", "broker.pub of a CURVE broker; plaintext if empty")
+    clientKey  = flag.String("key", "", "our .secret key file, for brokers that allow-list client keys")
+    plainAuth  = flag.Bool("plain", false, "log in with a password (PLAIN authentication)")
+
+    endToEnd      = flag.Bool("e2e", false, "encrypt private messages end to end")
+    identityFile  = flag.String("identity", "chat_identity.key", "our end-to-end secret key, created if missing (with -e2e)")
+    knownKeysFile = flag.String("known-keys", "chat_known_keys", "the keys we have seen for other users (with -e2e)")
+)
+
+// CURVE keys for every broker connection, nil for plaintext
+var curve *keys.Client
+
+// PLAIN credentials, used when -plain is set
+var plainUsername, plainPassword string
+
+func brokerEndpoint(port int) string {
+    return fmt.Sprintf("tcp://%s:%d", *brokerHost, port)
+}
+
+// brokerSocket creates a socket for talking to the broker, encrypted when
+// a broker key was given and logged in when -plain is set. The caller
+// connects it.
+func brokerSocket(context *zmq.Context, t zmq.Type) (*zmq.Socket, error) {
+    socket, err := context.NewSocket(t)
+    if err != nil {
+        return nil, err
+    }
+    if err := curve.Apply(socket); err != nil {
+        socket.Close()
+        return nil, err
+    }
+    socket.SetLinger(closeLinger)
+    if *plainAuth {
+        socket.SetPlainUsername(plainUsername)
+        socket.SetPlainPassword(plainPassword)
+    }
+    return socket, nil
+}
+
+// controlRequest sends one request to the broker's control endpoint and
+// waits up to controlTimeout for the reply. A REQ socket that missed its
+// reply cannot send again, so each request gets a fresh socket.
+func controlRequest(context *zmq.Context, m *protocol.Message) (*protocol.Message, error) {
+    req, err := brokerSocket(context, zmq.REQ)
+    if err != nil {
+        return nil, err
+    }
+    defer req.Close()
+
+    req.SetLinger(0)
+    req.SetSndtimeo(controlTimeout)
+    req.SetRcvtimeo(controlTimeout)
+    if err := req.Connect(brokerEndpoint(controlPort)); err != nil {
+        return nil, err
+    }
+
+    if err := protocol.Send(req, m); err != nil {
+        return nil, fmt.Errorf("sending %s: %w", m.Command, err)
+    }
+    _, reply, err := protocol.Recv(req, 0)
+    if err != nil {
+        // A broker that rejects our credentials just drops the connection
+        if *plainAuth || *clientKey != "" {
+            return nil, fmt.Errorf("no reply to %s within %v (wrong password or key?): %w", m.Command, controlTimeout, err)
+        }
+        return nil, fmt.Errorf("no reply to %s within %v: %w", m.Command, controlTimeout, err)
+    }
+    return reply, nil
+}
+
+// describeError turns a control error code into a sentence for the user
+func describeError(code string) string {
+    switch code {
+    case protocol.CodeTaken:
+        return "Username already taken. Please choose another one."
+    case protocol.CodeInvalidName:
+        return "Username must be at most 32 printable characters without spaces."
+    case protocol.CodeUnknownUser:
+        return "No such user is online."
+    case protocol.CodeForbidden:
+        return "You are not allowed to do that."
+    case protocol.CodeRateLimited:
+        return "Too many requests, please wait a moment."
+    case protocol.CodeBanned:
+        return "You are banned from this chat, or were kicked a moment ago."
+    default:
+        return "The broker rejected the request (" + code + ")."
+    }
+}
+
+// Delivery status of a message we sent. It only ever moves forward.
+type status int
+
+const (
+    statusPending   status = iota // not yet acknowledged by the broker
+    statusSent                    // accepted by the broker
+    statusDelivered               // arrived at the recipient's client
+    statusRead                    // seen by the recipient
+)
+
+func (s status) String() string {
+    switch s {
+    case statusSent:
+        return "sent"
+    case statusDelivered:
+        return "delivered"
+    case statusRead:
+        return "read"
+    default:
+        return "pending"
+    }
+}
+
+type outgoing struct {
+    target string
+    text   string
+    id     string // assigned by the broker on ACK
+    status status
+}
+
+// outbox tracks the status of our recent messages. Outgoing messages
+// carry a local reference in their ID field until the broker's ACK maps
+// it to the broker's message ID.
+type outbox struct {
+    mutex   sync.Mutex
+    lastRef int
+    order   []*outgoing
+    byRef   map[string]*outgoing
+    byID    map[string]*outgoing
+}
+
+func newOutbox() *outbox {
+    return &outbox{
+        byRef: make(map[string]*outgoing),
+        byID:  make(map[string]*outgoing),
+    }
+}
+
+// add records a message about to be sent and returns its reference
+func (o *outbox) add(target, text string) string {
+    o.mutex.Lock()
+    defer o.mutex.Unlock()
+
+    o.lastRef++
+    ref := strconv.Itoa(o.lastRef)
+    message := &outgoing{target: target, text: text}
+    o.byRef[ref] = message
+    o.order = append(o.order, message)
+
+    // Forget the oldest message once the outbox is full
+    if len(o.order) > outboxSize {
+        oldest := o.order[0]
+        o.order = o.order[1:]
+        for r, m := range o.byRef {
+            if m == oldest {
+                delete(o.byRef, r)
+            }
+        }
+        delete(o.byID, oldest.id)
+    }
+    return ref
+}
+
+// acknowledge marks the message with reference ref as sent under the
+// broker's id
+func (o *outbox) acknowledge(ref, id string) (*outgoing, bool) {
+    o.mutex.Lock()
+    defer o.mutex.Unlock()
+
+    message, ok := o.byRef[ref]
+    if !ok {
+        return nil, false
+    }
+    delete(o.byRef, ref)
+    message.id = id
+    o.byID[id] = message
+    if message.status < statusSent {
+        message.status = statusSent
+    }
+    return message, true
+}
+
+// advance records a receipt for the message with the broker's id and
+// reports whether its status changed
+func (o *outbox) advance(id string, s status) (*outgoing, bool) {
+    o.mutex.Lock()
+    defer o.mutex.Unlock()
+
+    message, ok := o.byID[id]
+    if !ok || message.status >= s {
+        return nil, false
+    }
+    message.status = s
+    return message, true
+}
+
+// recent describes the last n messages and their status
+func (o *outbox) recent(n int) []string {
+    o.mutex.Lock()
+    defer o.mutex.Unlock()
+
+    start := len(o.order) - n
+    if start < 0 {
+        start = 0
+    }
+    var lines []string
+    for _, message := range o.order[start:] {
+        lines = append(lines, fmt.Sprintf("[%s] %s: %s", message.status, message.target, message.text))
+    }
+    return lines
+}
+
+// preview shortens a message for status lines
+func preview(text string) string {
+    const max = 30
+    if runes := []rune(text); len(runes) > max {
+        return string(runes[:max]) + "..."
+    }
+    return text
+}
+
+// A file offered by us or to us
+type fileOffer struct {
+    id   string // transfer ID, assigned by the broker
+    peer string
+    name string
+    path string // file to send, or where to save it
+    size int64
+}
+
+// fileOffers tracks the offers we made, by local reference until the
+// broker's ACK gives them a transfer ID, and the offers made to us
+type fileOffers struct {
+    mutex    sync.Mutex
+    lastRef  int
+    pending  map[string]*fileOffer // reference -> our offer
+    outgoing map[string]*fileOffer // transfer ID -> our offer
+    incoming map[string]*fileOffer // transfer ID -> offer to us
+}
+
+func newFileOffers() *fileOffers {
+    return &fileOffers{
+        pending:  make(map[string]*fileOffer),
+        outgoing: make(map[string]*fileOffer),
+        incoming: make(map[string]*fileOffer),
+    }
+}
+
+// offer records an offer about to be sent and returns its reference.
+// References start with 'f' so they never clash with the outbox's.
+func (f *fileOffers) offer(o *fileOffer) string {
+    f.mutex.Lock()
+    defer f.mutex.Unlock()
+
+    f.lastRef++
+    ref := "f" + strconv.Itoa(f.lastRef)
+    f.pending[ref] = o
+    return ref
+}
+
+// acknowledge gives our offer with reference ref its transfer ID
+func (f *fileOffers) acknowledge(ref, id string) (*fileOffer, bool) {
+    f.mutex.Lock()
+    defer f.mutex.Unlock()
+
+    o, ok := f.pending[ref]
+    if !ok {
+        return nil, false
+    }
+    delete(f.pending, ref)
+    o.id = id
+    f.outgoing[id] = o
+    return o, true
+}
+
+// answered removes our offer once the recipient accepted or declined it
+func (f *fileOffers) answered(id string) (*fileOffer, bool) {
+    f.mutex.Lock()
+    defer f.mutex.Unlock()
+
+    o, ok := f.outgoing[id]
+    delete(f.outgoing, id)
+    return o, ok
+}
+
+func (f *fileOffers) offered(o *fileOffer) {
+    f.mutex.Lock()
+    defer f.mutex.Unlock()
+    f.incoming[o.id] = o
+}
+
+// take removes an offer made to us so it can be accepted or declined
+func (f *fileOffers) take(id string) (*fileOffer, bool) {
+    f.mutex.Lock()
+    defer f.mutex.Unlock()
+
+    o, ok := f.incoming[id]
+    delete(f.incoming, id)
+    return o, ok
+}
+
+// formatSize renders a byte count for people
+func formatSize(n int64) string {
+    const unit = 1024
+    if n < unit {
+        return fmt.Sprintf("%d B", n)
+    }
+    div, exp := int64(unit), 0
+    for m := n / unit; m >= unit; m /= unit {
+        div *= unit
+        exp++
+    }
+    return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// showProgress prints a transfer's progress in steps of 10%
+func showProgress(label string) transfer.Progress {
+    shown := -1
+    return func(done, total int64) {
+        step := 10
+        if total > 0 {
+            step = int(done * 10 / total)
+        }
+        if step == shown {
+            return
+        }
+        shown = step
+        fmt.Printf("\n[File] %s: %d%% (%s of %s)\n", label, step*10, formatSize(done), formatSize(total))
+        fmt.Print("Enter message: ")
+    }
+}
+
+// runTransfer streams one side of a transfer on its own socket and
+// goroutine, so chat keeps flowing meanwhile
+func runTransfer(context *zmq.Context, username string, o *fileOffer, sending bool) {
+    go func() {
+        result := func(err error) {
+            if err != nil {
+                fmt.Printf("\n[File] %s failed: %v\n", o.name, err)
+            } else if sending {
+                fmt.Printf("\n[File] %s sent to %s\n", o.name, o.peer)
+            } else {
+                fmt.Printf("\n[File] %s from %s saved as %s\n", o.name, o.peer, o.path)
+            }
+            fmt.Print("Enter message: ")
+        }
+
+        socket, err := brokerSocket(context, zmq.DEALER)
+        if err != nil {
+            result(err)
+            return
+        }
+        defer socket.Close()
+        socket.SetIdentity(transfer.Identity(username, o.id))
+        if err := socket.Connect(brokerEndpoint(dataPort)); err != nil {
+            result(err)
+            return
+        }
+
+        if !sending {
+            result(transfer.Receive(socket, o.id, o.path, o.size, showProgress(o.name)))
+            return
+        }
+
+        file, err := os.Open(o.path)
+        if err != nil {
+            transfer.Cancel(socket, o.id, "cannot open file")
+            result(err)
+            return
+        }
+        defer file.Close()
+        result(transfer.Send(socket, o.id, file, o.size, showProgress(o.name)))
+    }()
+}
+
+// shown is a chat message we displayed or sent. The broker refers to it
+// by its ID, our user by its local number.
+type shown struct {
+    n         int
+    id        string
+    sender    string
+    target    string // "#room" or the recipient
+    text      string
+    parent    string // ID of the message it replies to
+    edited    bool
+    deletedBy string // "" while the message stands
+}
+
+// conversation keeps our recent chat messages, so edits and deletes can
+// be applied to them and replies shown as threads
+type conversation struct {
+    mutex sync.Mutex
+    last  int
+    order []*shown
+    byN   map[int]*shown
+    byID  map[string]*shown
+}
+
+func newConversation() *conversation {
+    return &conversation{
+        byN:  make(map[int]*shown),
+        byID: make(map[string]*shown),
+    }
+}
+
+// add records a chat message and reports whether it is new to us
+func (c *conversation) add(id, sender, target, body string) (*shown, bool) {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+
+    if s, ok := c.byID[id]; ok {
+        return s, false
+    }
+
+    c.last++
+    s := &shown{n: c.last, id: id, sender: sender, target: target, text: body}
+    if parent, text, ok := protocol.IsReply(body); ok {
+        s.parent, s.text = parent, text
+    }
+    c.byN[s.n] = s
+    c.byID[id] = s
+    c.order = append(c.order, s)
+
+    if len(c.order) > keptMessages {
+        oldest := c.order[0]
+        c.order = c.order[1:]
+        delete(c.byN, oldest.n)
+        delete(c.byID, oldest.id)
+    }
+    return s, true
+}
+
+// change applies an EDIT or DELETE to the message it names
+func (c *conversation) change(m *protocol.Message) (*shown, bool) {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+
+    s, ok := c.byID[m.ID]
+    if !ok {
+        return nil, false
+    }
+    if m.Command == protocol.Delete {
+        s.deletedBy = m.Sender
+        s.text = ""
+    } else {
+        s.text = m.Body
+        s.edited = true
+    }
+    return s, true
+}
+
+// find looks a message up by the number we showed it with
+func (c *conversation) find(number string) (*shown, bool) {
+    n, err := strconv.Atoi(strings.Trim(number, "()"))
+    if err != nil {
+        return nil, false
+    }
+
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    s, ok := c.byN[n]
+    return s, ok
+}
+
+// lastFrom returns the newest message username has not deleted
+func (c *conversation) lastFrom(username string) (*shown, bool) {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+
+    for i := len(c.order) - 1; i >= 0; i-- {
+        if s := c.order[i]; s.sender == username && s.deletedBy == "" {
+            return s, true
+        }
+    }
+    return nil, false
+}
+
+// format renders a message indented by how deep in a thread it is
+func (c *conversation) format(s *shown) string {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    return c.formatLocked(s, c.depthLocked(s), true)
+}
+
+func (c *conversation) depthLocked(s *shown) int {
+    depth := 0
+    for s.parent != "" && depth < maxDepth {
+        parent, ok := c.byID[s.parent]
+        if !ok {
+            break
+        }
+        s = parent
+        depth++
+    }
+    return depth
+}
+
+// formatLocked renders s at depth. Outside a thread view other messages
+// come in between, so a reply also says which message it answers.
+func (c *conversation) formatLocked(s *shown, depth int, showParent bool) string {
+    line := fmt.Sprintf("(%d) %s", s.n, strings.Repeat(indent, depth))
+    if s.parent != "" {
+        line += "↳ "
+        parent, ok := c.byID[s.parent]
+        switch {
+        case !ok:
+            line += "re an earlier message, "
+        case showParent:
+            line += fmt.Sprintf("re (%d) %s, ", parent.n, parent.sender)
+        }
+    }
+
+    switch {
+    case s.deletedBy == s.sender:
+        return line + "[message deleted]"
+    case s.deletedBy != "":
+        return line + fmt.Sprintf("[message deleted by %s]", s.deletedBy)
+    case s.edited:
+        return line + formatChat(s.sender, s.text) + " (edited)"
+    default:
+        return line + formatChat(s.sender, s.text)
+    }
+}
+
+// thread renders the whole thread s belongs to, each reply indented
+// under the message it answers
+func (c *conversation) thread(s *shown) []string {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+
+    root := s
+    for root.parent != "" {
+        parent, ok := c.byID[root.parent]
+        if !ok {
+            break
+        }
+        root = parent
+    }
+
+    var lines []string
+    var walk func(s *shown, depth int)
+    walk = func(s *shown, depth int) {
+        lines = append(lines, c.formatLocked(s, min(depth, maxDepth), false))
+        for _, reply := range c.order {
+            if reply.parent == s.id {
+                walk(reply, depth+1)
+            }
+        }
+    }
+    walk(root, 0)
+    return lines
+}
+
+// A command is one of the slash commands typed at the input line
+type command struct {
+    usage string // arguments, shown by /help and on misuse
+    help  string
+    args  int // arguments required
+    run   func(args []string, rest string)
+}
+
+// parseCommand splits "/name rest of line" into the command name and
+// the raw text after it
+func parseCommand(line string) (name, rest string) {
+    line = strings.TrimPrefix(line, "/")
+    name, rest, _ = strings.Cut(line, " ")
+    return strings.ToLower(name), strings.TrimSpace(rest)
+}
+
+// unknownCommand explains a mistyped command, suggesting the commands
+// it could have been meant as
+func unknownCommand(commands map[string]*command, name string) string {
+    var similar []string
+    for candidate := range commands {
+        if name != "" && (strings.HasPrefix(candidate, name) || strings.HasPrefix(name, candidate)) {
+            similar = append(similar, "/"+candidate)
+        }
+    }
+    sort.Strings(similar)
+
+    text := fmt.Sprintf("Unknown command /%s, nothing was sent.", name)
+    if len(similar) > 0 {
+        text += " Did you mean " + strings.Join(similar, " or ") + "?"
+    }
+    return text + " Type /help to see the commands, or start a line with // to send it as text."
+}
+
+func helpText(commands map[string]*command) string {
+    names := make([]string, 0, len(commands))
+    for name := range commands {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+
+    var text strings.Builder
+    text.WriteString("Commands:\n")
+    for _, name := range names {
+        c := commands[name]
+        fmt.Fprintf(&text, "  %-24s %s\n", strings.TrimSpace("/"+name+" "+c.usage), c.help)
+    }
+    text.WriteString("Anything else is sent to the current room; '@user text' and '#room text' pick another target.\n")
+    return text.String()
+}
+
+// formatChat renders chat text, showing /me actions as such
+func formatChat(sender, text string) string {
+    if action, ok := protocol.IsAction(text); ok {
+        return fmt.Sprintf("* %s %s", sender, action)
+    }
+    return fmt.Sprintf("%s: %s", sender, text)
+}
+
+// formatUserList renders a LIST reply: one user per line, each followed
+// by a tab and their away message if they have one
+func formatUserList(body string) string {
+    if body == "" {
+        return "Nobody is online"
+    }
+    entries := strings.Split(body, "\n")
+    for i, entry := range entries {
+        if name, away, ok := strings.Cut(entry, "\t"); ok {
+            entries[i] = fmt.Sprintf("%s (away: %s)", name, away)
+        }
+    }
+    return fmt.Sprintf("Online (%d): %s", len(entries), strings.Join(entries, ", "))
+}
+
 func main() {
-    context, _ := zmq.NewContext()
-    defer context.Term()
+    flag.Parse()
 
-    var username string
+    if *brokerKey != "" {
+        var err error
+        if *clientKey != "" {
+            curve, err = keys.LoadClient(*brokerKey, *clientKey)
+        } else {
+            curve, err = keys.NewClient(*brokerKey)
+        }
+        if err != nil {
+            fmt.Println("Failed to load keys:", err)
+            os.Exit(1)
+        }
+    }
 
-    // Socket to send messages
-    publisher, _ := context.NewSocket(zmq.PUB)
-    defer publisher.Close()
-    publisher.Connect("tcp://localhost:5555")
+    // Our end-to-end identity, and the keys we pinned for everyone else
+    var identity *e2e.Identity
+    var known *e2e.KnownKeys
+    if *endToEnd {
+        var err error
+        if identity, err = e2e.LoadIdentity(*identityFile); err != nil {
+            fmt.Println("Failed to load identity key:", err)
+            os.Exit(1)
+        }
+        if known, err = e2e.OpenKnownKeys(*knownKeysFile); err != nil {
+            fmt.Println("Failed to load known keys:", err)
+            os.Exit(1)
+        }
+    }
 
-    // Socket to receive messages
-    subscriber, _ := context.NewSocket(zmq.SUB)
-    defer subscriber.Close()
-    subscriber.Connect("tcp://localhost:5556")
-    subscriber.SetSubscribe("")
+    context, _ := zmq.NewContext()
+    defer context.Term()
 
-    // Wait for connection to establish
-    time.Sleep(time.Second)
+    // Our name, and the session token that lets us take it back after
+    // losing the broker
+    var username, token string
 
     reader := bufio.NewReader(os.Stdin)
-    
+
     // Username registration
     for {
         fmt.Print("Enter your name: ")
@@ -42,101 +752,973 @@ func main() {
             fmt.Println("Username cannot be empty")
             continue
         }
+        if !protocol.ValidUsername(username) {
+            fmt.Println("Username must be at most 32 printable characters without spaces")
+            continue
+        }
 
-        // Send registration request
-        publisher.Send(fmt.Sprintf("REGISTER:%s:request", username), 0)
+        if *plainAuth {
+            // Echoed, as the client has no raw terminal handling
+            fmt.Print("Password: ")
+            plainPassword, _ = reader.ReadString('\n')
+            plainPassword = strings.TrimRight(plainPassword, "\r\n")
+            plainUsername = username
+        }
 
-        // Wait for response
-        for {
-            message, err := subscriber.Recv(0)
-            if err != nil {
-                continue
+        // Register on the control endpoint; the answer comes back to us
+        // alone, whether or not the chat sockets have connected yet
+        reply, err := controlRequest(context, protocol.New(protocol.Register, username, "", ""))
+        if err != nil {
+            fmt.Println("Could not reach the broker:", err)
+            continue
+        }
+        if reply.Command == protocol.OK {
+            token = reply.Body
+            break
+        }
+        fmt.Println(describeError(reply.Body))
+    }
+
+    // Socket to send messages
+    publisher, _ := brokerSocket(context, zmq.PUB)
+    publisher.Connect(brokerEndpoint(publishPort))
+
+    // Socket to receive messages
+    subscriber, _ := brokerSocket(context, zmq.SUB)
+    subscriber.Connect(brokerEndpoint(subscribePort))
+
+    // Our name changes with /nick and is read by every goroutine
+    var nameMutex sync.Mutex
+    me := func() string {
+        nameMutex.Lock()
+        defer nameMutex.Unlock()
+        return username
+    }
+    rename := func(name string) {
+        nameMutex.Lock()
+        defer nameMutex.Unlock()
+        username = name
+    }
+
+    // The publisher is shared with the heartbeat goroutine
+    var sendMutex sync.Mutex
+    publish := func(m *protocol.Message) {
+        sendMutex.Lock()
+        defer sendMutex.Unlock()
+        protocol.Send(publisher, m)
+    }
+    defer func() {
+        sendMutex.Lock()
+        defer sendMutex.Unlock()
+        publisher.Close()
+    }()
+    send := func(command, target, body string) {
+        publish(protocol.New(command, me(), target, body))
+    }
+
+    // publishKey tells the broker our end-to-end key, so others can
+    // encrypt for us. It is published again whenever the broker may
+    // have forgotten it.
+    publishKey := func() {
+        if identity == nil {
+            return
+        }
+        reply, err := controlRequest(context, protocol.New(protocol.SetKey, me(), "", token+" "+identity.Public()))
+        if err != nil || reply.Command != protocol.OK {
+            fmt.Println("\n[System] Could not publish your encryption key; nobody can send you encrypted messages")
+        }
+    }
+    publishKey()
+
+    // Keys other users published, as the broker gave them to us
+    var keysMutex sync.Mutex
+    peerKeys := make(map[string]string)
+
+    // peerKey returns username's published key, asking the broker unless
+    // we have it already and fresh is not set
+    peerKey := func(username string, fresh bool) (string, bool) {
+        keysMutex.Lock()
+        key, ok := peerKeys[username]
+        keysMutex.Unlock()
+        if ok && !fresh {
+            return key, true
+        }
+
+        reply, err := controlRequest(context, protocol.New(protocol.GetKey, me(), username, ""))
+        if err != nil || reply.Command != protocol.OK {
+            return "", false
+        }
+        keysMutex.Lock()
+        peerKeys[username] = reply.Body
+        keysMutex.Unlock()
+        return reply.Body, true
+    }
+
+    // checkKey pins the first key we see for a user and warns when a
+    // later one differs: the broker, or whoever took over the name,
+    // could be reading along
+    checkKey := func(username, key string) bool {
+        same, pinned, err := known.Check(username, key)
+        if err != nil {
+            fmt.Println("\n[System] Could not save known keys:", err)
+        }
+        if !same {
+            fmt.Printf("\n[Warning] The encryption key of %s has changed from %s to %s!\n"+
+                "Someone else may be using the name, or they set up a new client. Check with them, then type '/trust %s'.\n",
+                username, e2e.Fingerprint(pinned), e2e.Fingerprint(key), username)
+        }
+        return same
+    }
+
+    // Users our user agreed to message in the clear while they have no
+    // encryption key. Only the input loop touches it.
+    insecure := make(map[string]bool)
+
+    // seal encrypts a private message for its recipient. It reports
+    // false when the message must not be sent: without a key it only
+    // goes out in the clear if the user allowed that with /insecure, and
+    // never to someone whose key we pinned.
+    seal := func(m *protocol.Message) bool {
+        if identity == nil {
+            return true
+        }
+        // Always asked afresh, so we never encrypt for an old key
+        key, ok := peerKey(m.Target, true)
+        if !ok {
+            if pinned, ok := known.Pinned(m.Target); ok {
+                fmt.Printf("Could not get the encryption key of %s (pinned %s). Not sent.\n", m.Target, e2e.Fingerprint(pinned))
+                return false
             }
+            if !insecure[m.Target] {
+                fmt.Printf("%s has no encryption key. Not sent; type '/insecure %s' to message them in the clear.\n", m.Target, m.Target)
+                return false
+            }
+            return true
+        }
+        if !checkKey(m.Target, key) {
+            fmt.Println("Not sent.")
+            return false
+        }
+        body, err := identity.Seal(m.Body, key)
+        if err != nil {
+            fmt.Println("Could not encrypt the message:", err)
+            return false
+        }
+        m.Body = body
+        return true
+    }
 
-            parts := strings.SplitN(message, ":", 3)
-            if len(parts) != 3 {
-                continue
+    // unseal decrypts a sealed private body exchanged with peer
+    unseal := func(body, peer string) string {
+        if identity == nil {
+            return "[encrypted message; start the client with -e2e to read it]"
+        }
+        // A failure with the key we have may mean the peer has a new one
+        for _, fresh := range []bool{false, true} {
+            key, ok := peerKey(peer, fresh)
+            if !ok {
+                break
             }
+            if text, err := identity.Open(body, key); err == nil {
+                checkKey(peer, key)
+                return text
+            }
+        }
+        return "[encrypted message that could not be decrypted]"
+    }
 
-            command := parts[0]
-            user := parts[1]
+    // Status of the messages we send, and direct messages we received
+    // but our user has not seen yet
+    sent := newOutbox()
+    files := newFileOffers()
+    chats := newConversation()
+    var unreadMutex sync.Mutex
+    var unread []*protocol.Message
 
-            if user != username {
-                continue
-            }
+    fmt.Printf("\nWelcome to the chat, %s!\nType '@username message' for private messages, '#room message' to talk in a room,\nor '/help' to see the commands.\n\n", username)
+    if identity != nil {
+        fmt.Printf("Private messages are encrypted end to end. Your key fingerprint is %s.\n\n", e2e.Fingerprint(identity.Public()))
+    }
 
-            if command == "REGISTER_OK" {
-                goto CHAT_START
-            } else if command == "REGISTER_FAIL" {
-                fmt.Println("Username already taken. Please choose another one.")
+    // The receiver goroutine owns the dealer; the input loop hands it
+    // outgoing private messages, and our new name after /nick, through
+    // these channels
+    direct := make(chan *protocol.Message, 16)
+    renamed := make(chan string, 1)
+
+    // The rooms we are in, to be put back in after a reconnect
+    var roomsMutex sync.Mutex
+    joined := make(map[string]bool)
+    roomList := func() string {
+        roomsMutex.Lock()
+        defer roomsMutex.Unlock()
+        rooms := make([]string, 0, len(joined))
+        for room := range joined {
+            rooms = append(rooms, room)
+        }
+        sort.Strings(rooms)
+        return strings.Join(rooms, ",")
+    }
+
+    // When the broker last answered a heartbeat, and a signal that it
+    // answered it no longer knows us
+    var lastBeat atomic.Int64
+    lastBeat.Store(time.Now().UnixNano())
+    forgotten := make(chan struct{}, 1)
+
+    // reconnect takes our session back, retrying with exponential
+    // backoff. ZeroMQ reconnects the sockets by itself and renews our
+    // subscriptions; the broker just has to learn who we are again.
+    reconnect := func(reason string) {
+        fmt.Printf("\n[System] %s, reconnecting\n", reason)
+        for delay := initialBackoff; ; delay = min(delay*2, maxBackoff) {
+            reply, err := controlRequest(context, protocol.New(protocol.Resume, me(), roomList(), token))
+            if err == nil && reply.Command == protocol.OK {
                 break
             }
+            if err == nil && reply.Body == protocol.CodeTaken {
+                fmt.Printf("\n[System] Someone else took the name %s meanwhile. Please restart the client.\n", me())
+                os.Exit(1)
+            }
+            if err == nil && reply.Body == protocol.CodeBanned {
+                fmt.Printf("\n[System] %s\n", describeError(reply.Body))
+                os.Exit(1)
+            }
+            fmt.Printf("\n[System] The broker is unreachable, retrying in %v\n", delay)
+            time.Sleep(delay)
         }
+
+        lastBeat.Store(time.Now().UnixNano())
+        direct <- protocol.New(protocol.Hello, me(), "", "ready")
+        publishKey()
+        fmt.Println("\n[System] Reconnected")
+        fmt.Print("Enter message: ")
     }
 
-CHAT_START:
-    fmt.Printf("\nWelcome to the chat, %s!\nType '@username message' for private messages or 'quit' to exit.\n\n", username)
+    // Closed when the user quits. The receiver goroutine owns the
+    // subscriber and the dealer and closes them itself, before main
+    // terminates the context.
+    done := make(chan struct{})
+    stopped := make(chan struct{})
 
-    // Start message receiver
+    // Keep our name reserved while we are connected, and notice when we
+    // are not
     go func() {
+        ticker := time.NewTicker(heartbeatInterval)
+        defer ticker.Stop()
         for {
-            message, err := subscriber.Recv(0)
-            if err != nil {
-                continue
+            select {
+            case <-done:
+                return
+
+            case <-ticker.C:
+                if time.Since(time.Unix(0, lastBeat.Load())) > brokerTimeout {
+                    reconnect("Lost contact with the broker")
+                    continue
+                }
+                send(protocol.Heartbeat, "", "alive")
+
+            case <-forgotten:
+                reconnect("The broker has lost our session")
             }
+        }
+    }()
 
-            parts := strings.SplitN(message, ":", 3)
-            if len(parts) != 3 {
-                continue
+    // Start message receiver. Subscriptions follow the broker's view of
+    // our rooms, so ZeroMQ drops traffic for rooms we are not in.
+    go func() {
+        // Private messages travel over a DEALER whose identity is our
+        // username, so the broker's ROUTER can deliver them to us alone.
+        // A new name needs a new identity, and so a new socket.
+        var dealer *zmq.Socket
+        var poller *zmq.Poller
+        defer close(stopped)
+        defer subscriber.Close()
+        defer func() {
+            if dealer != nil {
+                dealer.Close()
             }
+        }()
+        connectDirect := func(name string) {
+            if dealer != nil {
+                dealer.Close()
+            }
+            dealer, _ = brokerSocket(context, zmq.DEALER)
+            dealer.SetIdentity(name)
+            dealer.Connect(brokerEndpoint(directPort))
+            protocol.Send(dealer, protocol.New(protocol.Hello, name, "", "ready"))
+
+            poller = zmq.NewPoller()
+            poller.Add(subscriber, zmq.POLLIN)
+            poller.Add(dealer, zmq.POLLIN)
+        }
+        connectDirect(me())
 
-            sender := parts[0]
-            target := parts[1]
-            content := parts[2]
+        for {
+            select {
+            case <-done:
+                return
+            case name := <-renamed:
+                connectDirect(name)
+            default:
+            }
 
-            // Skip own messages
-            if sender == username {
+            // Flush queued private messages
+            for flushed := false; !flushed; {
+                select {
+                case message := <-direct:
+                    protocol.Send(dealer, message)
+                default:
+                    flushed = true
+                }
+            }
+
+            polled, err := poller.Poll(pollInterval)
+            if err != nil {
                 continue
             }
 
-            // Show message if it's for everyone or specifically for this user
-            if target == "all" || target == username {
-                if sender == "SYSTEM" {
-                    fmt.Printf("\n[System] %s\n", content)
-                } else {
-                    fmt.Printf("\n%s: %s\n", sender, content)
+            for _, item := range polled {
+                // Room traffic carries a topic frame, direct traffic does not
+                prefixLen := 0
+                if item.Socket == subscriber {
+                    prefixLen = 1
+                }
+
+                _, m, err := protocol.Recv(item.Socket, prefixLen)
+                if err != nil {
+                    fmt.Printf("\n[System] Dropped a message from the broker: %v\n", err)
+                    fmt.Print("Enter message: ")
+                    continue
+                }
+
+                switch m.Command {
+                case protocol.Heartbeat:
+                    lastBeat.Store(time.Now().UnixNano())
+                    if m.Body == protocol.SessionUnknown {
+                        select {
+                        case forgotten <- struct{}{}:
+                        default:
+                        }
+                    }
+                    continue
+
+                case protocol.JoinOK:
+                    roomsMutex.Lock()
+                    joined[m.Body] = true
+                    roomsMutex.Unlock()
+                    subscriber.SetSubscribe(protocol.RoomTopic(m.Body))
+                    fmt.Printf("\n[System] You are now in #%s\n", m.Body)
+
+                case protocol.LeaveOK:
+                    roomsMutex.Lock()
+                    delete(joined, m.Body)
+                    roomsMutex.Unlock()
+                    subscriber.SetUnsubscribe(protocol.RoomTopic(m.Body))
+                    fmt.Printf("\n[System] You left #%s\n", m.Body)
+
+                case protocol.JoinFail:
+                    // The broker follows up with a SYSTEM line explaining why
+                    continue
+
+                case protocol.History:
+                    s, _ := chats.add(m.ID, m.Sender, m.Target, m.Body)
+                    if m.Body == "" {
+                        // Deleted; the DELETE replayed next shows it so
+                        continue
+                    }
+                    fmt.Printf("\n[%s] [%s] %s\n", m.Target, m.Time.Format("Jan 2 15:04"), chats.format(s))
+
+                case protocol.Edit, protocol.Delete:
+                    if e2e.IsSealed(m.Body) {
+                        peer := m.Sender
+                        if peer == me() {
+                            peer = m.Target
+                        }
+                        m.Body = unseal(m.Body, peer)
+                    }
+                    s, ok := chats.change(m)
+                    if !ok {
+                        continue
+                    }
+                    if protocol.IsRoom(m.Target) {
+                        fmt.Printf("\n[%s] %s\n", m.Target, chats.format(s))
+                    } else {
+                        fmt.Printf("\n(private) %s\n", chats.format(s))
+                    }
+
+                case protocol.System:
+                    if protocol.IsRoom(m.Target) {
+                        fmt.Printf("\n[System %s] %s\n", m.Target, m.Body)
+                    } else {
+                        fmt.Printf("\n[System] %s\n", m.Body)
+                    }
+
+                case protocol.Error:
+                    fmt.Printf("\n[Error] %s\n", m.Body)
+
+                case protocol.Kicked:
+                    // The broker has forgotten us and will not take us
+                    // back for a while, so reconnecting is pointless
+                    fmt.Printf("\n[System] %s\n", m.Body)
+                    os.Exit(1)
+
+                case protocol.Offer:
+                    size, name, ok := protocol.ParseOffer(m.Body)
+                    if !ok {
+                        continue
+                    }
+                    // Never let the sender pick a directory for us
+                    name = filepath.Base(name)
+                    files.offered(&fileOffer{id: m.ID, peer: m.Sender, name: name, size: size})
+                    fmt.Printf("\n[File] %s offers you %s (%s). Type '/accept %s [path]' or '/decline %s'\n", m.Sender, name, formatSize(size), m.ID, m.ID)
+
+                case protocol.Accept:
+                    o, ok := files.answered(m.ID)
+                    if !ok {
+                        continue
+                    }
+                    fmt.Printf("\n[File] %s accepted %s, sending\n", o.peer, o.name)
+                    runTransfer(context, me(), o, true)
+
+                case protocol.Decline:
+                    if o, ok := files.answered(m.ID); ok {
+                        fmt.Printf("\n[File] %s declined %s\n", o.peer, o.name)
+                    }
+
+                case protocol.Ack:
+                    if o, ok := files.acknowledge(m.Body, m.ID); ok {
+                        fmt.Printf("\n[File] Offered %s to %s, waiting for an answer\n", o.name, o.peer)
+                        break
+                    }
+                    message, ok := sent.acknowledge(m.Body, m.ID)
+                    if !ok {
+                        continue
+                    }
+                    // Kept so /edit, /delete and /reply can refer to it
+                    s, _ := chats.add(m.ID, me(), strings.TrimPrefix(message.target, "@"), message.text)
+                    if protocol.IsRoom(message.target) {
+                        // Room messages get no receipts, so sent is all
+                        // there is to say; /status lists them
+                        continue
+                    }
+                    fmt.Printf("\n[%s] (%d) to %s: %s\n", message.status, s.n, message.target, preview(s.text))
+
+                case protocol.Delivered, protocol.Read:
+                    s := statusDelivered
+                    if m.Command == protocol.Read {
+                        s = statusRead
+                    }
+                    message, ok := sent.advance(m.ID, s)
+                    if !ok {
+                        continue
+                    }
+                    fmt.Printf("\n[%s] to %s: %s\n", message.status, message.target, preview(message.text))
+
+                case protocol.Msg:
+                    label := "(private)"
+                    if !protocol.IsRoom(m.Target) && e2e.IsSealed(m.Body) {
+                        m.Body = unseal(m.Body, m.Sender)
+                        label = "(private, encrypted)"
+                    }
+                    s, _ := chats.add(m.ID, m.Sender, m.Target, m.Body)
+
+                    // Skip own messages
+                    if m.Sender == me() {
+                        continue
+                    }
+
+                    if protocol.IsRoom(m.Target) {
+                        fmt.Printf("\n[%s] %s\n", m.Target, chats.format(s))
+                    } else {
+                        fmt.Printf("\n%s %s\n", label, chats.format(s))
+
+                        // Tell the sender it arrived; it counts as read
+                        // once we type our next line
+                        receipt := protocol.New(protocol.Delivered, me(), m.Sender, "")
+                        receipt.ID = m.ID
+                        protocol.Send(dealer, receipt)
+
+                        unreadMutex.Lock()
+                        unread = append(unread, m)
+                        unreadMutex.Unlock()
+                    }
+
+                default:
+                    continue
                 }
                 fmt.Print("Enter message: ")
             }
         }
     }()
 
+    // Plain messages go to the room we joined last
+    currentRoom := defaultRoom
+
+    // say sends chat text to a room ("#room") or a user ("@user")
+    say := func(target, text string) {
+        m := protocol.New(protocol.Msg, me(), strings.TrimPrefix(target, "@"), text)
+        private := strings.HasPrefix(target, "@")
+        if private && !seal(m) {
+            return
+        }
+        m.ID = sent.add(target, text)
+        if private {
+            direct <- m
+            return
+        }
+        publish(m)
+    }
+
+    // change sends an EDIT or DELETE of s on the direct channel, where
+    // the broker knows it is from us; it passes it on the way s went
+    change := func(command string, s *shown, text string) {
+        m := protocol.New(command, me(), s.target, text)
+        m.ID = s.id
+        if !protocol.IsRoom(s.target) && command == protocol.Edit && !seal(m) {
+            return
+        }
+        direct <- m
+    }
+
+    // pick finds the message numbered by args[0], or when that is not a
+    // number our own last one, and returns the rest of the line
+    pick := func(args []string, rest string) (*shown, string, bool) {
+        if len(args) > 0 {
+            if _, err := strconv.Atoi(strings.Trim(args[0], "()")); err == nil {
+                s, ok := chats.find(args[0])
+                return s, strings.TrimSpace(strings.TrimPrefix(rest, args[0])), ok
+            }
+        }
+        s, ok := chats.lastFrom(me())
+        return s, rest, ok
+    }
+
+    // control sends a request to the broker's control endpoint and
+    // reports whether it succeeded, printing any error
+    control := func(command, target, body string) (string, bool) {
+        reply, err := controlRequest(context, protocol.New(command, me(), target, body))
+        if err != nil {
+            fmt.Println("Could not reach the broker:", err)
+            return "", false
+        }
+        if reply.Command != protocol.OK {
+            fmt.Println(describeError(reply.Body))
+            return "", false
+        }
+        return reply.Body, true
+    }
+
+    // moderate sends an admin request about target and prints the result
+    moderate := func(command, target, body string) {
+        if result, ok := control(command, strings.TrimPrefix(target, "@"), token+" "+strings.TrimSpace(body)); ok {
+            fmt.Println(result)
+        }
+    }
+
+    quitting := false
+    var commands map[string]*command
+    commands = map[string]*command{
+        "help": {
+            usage: "[command]",
+            help:  "list the commands, or explain one",
+            run: func(args []string, _ string) {
+                if len(args) > 0 {
+                    name := strings.TrimPrefix(args[0], "/")
+                    if c, ok := commands[name]; ok {
+                        fmt.Printf("/%s %s - %s\n", name, c.usage, c.help)
+                        return
+                    }
+                    fmt.Println(unknownCommand(commands, name))
+                    return
+                }
+                fmt.Print(helpText(commands))
+            },
+        },
+        "join": {
+            usage: "room",
+            help:  "join a room and make it the one plain messages go to",
+            args:  1,
+            run: func(args []string, _ string) {
+                currentRoom = strings.ToLower(strings.TrimPrefix(args[0], "#"))
+                send(protocol.Join, "", currentRoom)
+            },
+        },
+        "leave": {
+            usage: "[room]",
+            help:  "leave a room, by default the current one",
+            run: func(args []string, _ string) {
+                room := currentRoom
+                if len(args) > 0 {
+                    room = strings.ToLower(strings.TrimPrefix(args[0], "#"))
+                }
+                if room == currentRoom {
+                    currentRoom = defaultRoom
+                }
+                send(protocol.Leave, "", room)
+            },
+        },
+        "rooms": {
+            help: "list the rooms and how many people are in each",
+            run: func([]string, string) {
+                send(protocol.Rooms, "", "list")
+            },
+        },
+        "history": {
+            usage: "[n]",
+            help:  "show the last n messages of your rooms",
+            run: func(args []string, _ string) {
+                n := "20"
+                if len(args) > 0 {
+                    n = args[0]
+                }
+                send(protocol.History, "", n)
+            },
+        },
+        "who": {
+            help: "list everyone online",
+            run: func([]string, string) {
+                if body, ok := control(protocol.List, "", ""); ok {
+                    fmt.Println(formatUserList(body))
+                }
+            },
+        },
+        "whois": {
+            usage: "user",
+            help:  "look someone up",
+            args:  1,
+            run: func(args []string, _ string) {
+                if info, ok := control(protocol.Whois, strings.TrimPrefix(args[0], "@"), ""); ok {
+                    fmt.Println(info)
+                }
+            },
+        },
+        "msg": {
+            usage: "user message",
+            help:  "send a private message, like '@user message'",
+            args:  2,
+            run: func(args []string, rest string) {
+                text := strings.TrimSpace(strings.TrimPrefix(rest, args[0]))
+                say("@"+strings.TrimPrefix(args[0], "@"), text)
+            },
+        },
+        "reply": {
+            usage: "n message",
+            help:  "answer message (n) in its room or conversation",
+            args:  2,
+            run: func(args []string, rest string) {
+                s, ok := chats.find(args[0])
+                if !ok || s.deletedBy != "" {
+                    fmt.Printf("There is no message %s to reply to\n", args[0])
+                    return
+                }
+                target := s.target
+                if !protocol.IsRoom(target) {
+                    // Private: answer whoever is not us
+                    target = "@" + s.sender
+                    if s.sender == me() {
+                        target = "@" + s.target
+                    }
+                }
+                say(target, protocol.ReplyTo(s.id, strings.TrimSpace(strings.TrimPrefix(rest, args[0]))))
+            },
+        },
+        "edit": {
+            usage: "[n] message",
+            help:  "replace the text of message (n), by default your last one",
+            args:  1,
+            run: func(args []string, rest string) {
+                s, text, ok := pick(args, rest)
+                if !ok || text == "" {
+                    fmt.Println("Nothing to edit; usage: /edit [n] message")
+                    return
+                }
+                change(protocol.Edit, s, text)
+            },
+        },
+        "delete": {
+            usage: "[n]",
+            help:  "delete message (n), by default your last one",
+            run: func(args []string, rest string) {
+                s, _, ok := pick(args, rest)
+                if !ok {
+                    fmt.Println("Nothing to delete")
+                    return
+                }
+                change(protocol.Delete, s, "")
+            },
+        },
+        "thread": {
+            usage: "n",
+            help:  "show the thread message (n) belongs to",
+            args:  1,
+            run: func(args []string, _ string) {
+                s, ok := chats.find(args[0])
+                if !ok {
+                    fmt.Printf("There is no message %s\n", args[0])
+                    return
+                }
+                for _, line := range chats.thread(s) {
+                    fmt.Println(line)
+                }
+            },
+        },
+        "trust": {
+            usage: "user",
+            help:  "accept a new encryption key for someone, once you checked it with them",
+            args:  1,
+            run: func(args []string, _ string) {
+                if identity == nil {
+                    fmt.Println("Encryption is off; start the client with -e2e")
+                    return
+                }
+                user := strings.TrimPrefix(args[0], "@")
+                key, ok := peerKey(user, true)
+                if !ok {
+                    fmt.Printf("%s has not published an encryption key\n", user)
+                    return
+                }
+                if err := known.Trust(user, key); err != nil {
+                    fmt.Println("Could not save known keys:", err)
+                    return
+                }
+                fmt.Printf("Trusting the key of %s, fingerprint %s\n", user, e2e.Fingerprint(key))
+            },
+        },
+        "insecure": {
+            usage: "user",
+            help:  "send private messages to someone in the clear while they have no encryption key",
+            args:  1,
+            run: func(args []string, _ string) {
+                if identity == nil {
+                    fmt.Println("Encryption is off; private messages are already sent in the clear")
+                    return
+                }
+                user := strings.TrimPrefix(args[0], "@")
+                insecure[user] = true
+                fmt.Printf("Messages to %s go out in the clear until they publish a key\n", user)
+            },
+        },
+        "me": {
+            usage: "action",
+            help:  "describe what you are doing in the current room",
+            args:  1,
+            run: func(_ []string, rest string) {
+                say("#"+currentRoom, protocol.Action(rest))
+            },
+        },
+        "away": {
+            usage: "[message]",
+            help:  "mark yourself away with a message, or back without one",
+            run: func(_ []string, rest string) {
+                send(protocol.Away, "", rest)
+            },
+        },
+        "nick": {
+            usage: "name",
+            help:  "change your name",
+            args:  1,
+            run: func(args []string, _ string) {
+                name := args[0]
+                if !protocol.ValidUsername(name) {
+                    fmt.Println(describeError(protocol.CodeInvalidName))
+                    return
+                }
+                if _, ok := control(protocol.Nick, name, token); ok {
+                    rename(name)
+                    renamed <- name
+                    publishKey()
+                    fmt.Printf("You are now known as %s\n", name)
+                }
+            },
+        },
+        "kick": {
+            usage: "user [reason]",
+            help:  "disconnect someone (admins only)",
+            args:  1,
+            run: func(args []string, rest string) {
+                moderate(protocol.Kick, args[0], strings.TrimPrefix(rest, args[0]))
+            },
+        },
+        "ban": {
+            usage: "user|address [reason]",
+            help:  "disconnect and keep out a user, or everyone from an address (admins only)",
+            args:  1,
+            run: func(args []string, rest string) {
+                moderate(protocol.Ban, args[0], strings.TrimPrefix(rest, args[0]))
+            },
+        },
+        "unban": {
+            usage: "user|address",
+            help:  "let a banned or kicked user or address back in (admins only)",
+            args:  1,
+            run: func(args []string, _ string) {
+                moderate(protocol.Unban, args[0], "")
+            },
+        },
+        "mute": {
+            usage: "user duration [reason]",
+            help:  "stop someone from chatting for a while, e.g. '/mute bob 10m' (admins only)",
+            args:  2,
+            run: func(args []string, rest string) {
+                if _, err := time.ParseDuration(args[1]); err != nil {
+                    fmt.Println("Durations look like 30s, 10m or 1h")
+                    return
+                }
+                moderate(protocol.Mute, args[0], strings.TrimPrefix(rest, args[0]))
+            },
+        },
+        "send": {
+            usage: "@user path",
+            help:  "offer a file to someone",
+            args:  2,
+            run: func(args []string, rest string) {
+                peer := strings.TrimPrefix(args[0], "@")
+                path := strings.TrimSpace(strings.TrimPrefix(rest, args[0]))
+                info, err := os.Stat(path)
+                if err != nil {
+                    fmt.Println("Cannot send that file:", err)
+                    return
+                }
+                if !info.Mode().IsRegular() {
+                    fmt.Println("Only regular files can be sent")
+                    return
+                }
+
+                o := &fileOffer{peer: peer, name: filepath.Base(path), path: path, size: info.Size()}
+                m := protocol.New(protocol.Offer, me(), peer, fmt.Sprintf("%d %s", o.size, o.name))
+                m.ID = files.offer(o)
+                direct <- m
+            },
+        },
+        "accept": {
+            usage: "id [path]",
+            help:  "accept a file offered to you, saving it to path",
+            args:  1,
+            run: func(args []string, rest string) {
+                o, ok := files.take(args[0])
+                if !ok {
+                    fmt.Printf("No file offer %s is waiting for you\n", args[0])
+                    return
+                }
+                o.path = o.name
+                if path := strings.TrimSpace(strings.TrimPrefix(rest, args[0])); path != "" {
+                    o.path = path
+                }
+                if _, err := os.Stat(o.path); err == nil {
+                    fmt.Printf("%s already exists; choose another path with '/accept %s path'\n", o.path, o.id)
+                    files.offered(o)
+                    return
+                }
+
+                runTransfer(context, me(), o, false)
+                answer := protocol.New(protocol.Accept, me(), o.peer, "")
+                answer.ID = o.id
+                direct <- answer
+            },
+        },
+        "decline": {
+            usage: "id",
+            help:  "turn down a file offered to you",
+            args:  1,
+            run: func(args []string, _ string) {
+                o, ok := files.take(args[0])
+                if !ok {
+                    fmt.Printf("No file offer %s is waiting for you\n", args[0])
+                    return
+                }
+                answer := protocol.New(protocol.Decline, me(), o.peer, "")
+                answer.ID = o.id
+                direct <- answer
+            },
+        },
+        "status": {
+            help: "show what your recent messages reached",
+            run: func([]string, string) {
+                lines := sent.recent(10)
+                if len(lines) == 0 {
+                    fmt.Println("You have not sent anything yet")
+                }
+                for _, line := range lines {
+                    fmt.Println(line)
+                }
+            },
+        },
+        "quit": {
+            usage: "[message]",
+            help:  "leave the chat, telling your rooms why",
+            run: func(_ []string, rest string) {
+                if _, err := controlRequest(context, protocol.New(protocol.Unregister, me(), "", strings.TrimSpace(token+" "+rest))); err != nil {
+                    fmt.Println("Could not unregister:", err)
+                }
+                quitting = true
+            },
+        },
+    }
+
+    defer func() {
+        close(done)
+        <-stopped
+    }()
+
     // Message sending loop
-    for {
+    for !quitting {
         fmt.Print("Enter message: ")
         message, _ := reader.ReadString('\n')
         message = strings.TrimSpace(message)
 
-        if message == "quit" {
-            publisher.Send(fmt.Sprintf("UNREGISTER:%s:leaving", username), 0)
-            break
+        // Typing means the user has seen what was printed before
+        // The receiver takes the lock before draining direct, so it must
+        // not be held while we queue the receipts
+        unreadMutex.Lock()
+        seen := unread
+        unread = nil
+        unreadMutex.Unlock()
+        for _, m := range seen {
+            receipt := protocol.New(protocol.Read, me(), m.Sender, "")
+            receipt.ID = m.ID
+            direct <- receipt
         }
 
         if message == "" {
             continue
         }
 
-        targetUser := "all"
-        if strings.HasPrefix(message, "@") {
+        // Bare 'quit' predates the slash commands and still works
+        if message == "quit" {
+            message = "/quit"
+        }
+
+        // Lines starting with '/' are commands and never sent as chat;
+        // '//' sends a line starting with a literal '/'
+        if strings.HasPrefix(message, "//") {
+            message = message[1:]
+        } else if strings.HasPrefix(message, "/") {
+            name, rest := parseCommand(message)
+            c, ok := commands[name]
+            if !ok {
+                fmt.Println(unknownCommand(commands, name))
+                continue
+            }
+            args := strings.Fields(rest)
+            if len(args) < c.args {
+                fmt.Printf("Usage: /%s %s\n", name, c.usage)
+                continue
+            }
+            c.run(args, rest)
+            continue
+        }
+
+        target := "#" + currentRoom
+        if strings.HasPrefix(message, "@") || strings.HasPrefix(message, "#") {
             parts := strings.SplitN(message, " ", 2)
             if len(parts) == 2 {
-                targetUser = strings.TrimPrefix(parts[0], "@")
+                target = parts[0]
                 message = parts[1]
             }
         }
-
-        publisher.Send(fmt.Sprintf("%s:%s:%s", username, targetUser, message), 0)
+        say(target, message)
     }
 
     fmt.Println("Chat ended. Goodbye!")
-}
\ No newline at end of file
+}
@@ -0,0 +1,93 @@
+// Package durable writes the broker's files so that a crash never leaves
+// one half written: append-only files of lines, and files replaced whole.
+package durable
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Append writes line and a newline to the end of the file at path,
+// creating it with perm, and syncs it. It returns the file's new size.
+// The line must not contain newlines.
+func Append(path, line string, perm os.FileMode) (int64, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, perm)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	if _, err := file.WriteString(line + "\n"); err != nil {
+		return 0, err
+	}
+	if err := file.Sync(); err != nil {
+		return 0, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// ReadLines returns the lines of the file at path without their newlines.
+// A missing file has none. A last line without a newline is an Append a
+// crash cut short, so it is left out.
+func ReadLines(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var lines []string
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			break
+		}
+		lines = append(lines, strings.TrimSuffix(line, "\n"))
+	}
+	return lines, nil
+}
+
+// WriteLines replaces the file at path with lines, each followed by a
+// newline, the way WriteFile does
+func WriteLines(path string, lines []string) error {
+	var data strings.Builder
+	for _, line := range lines {
+		data.WriteString(line)
+		data.WriteByte('\n')
+	}
+	return WriteFile(path, []byte(data.String()))
+}
+
+// WriteFile replaces the file at path with data. It writes a temporary
+// file next to it, syncs it and renames it into place, so after a crash
+// the file holds either its old contents or data.
+func WriteFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,247 @@
+// Package e2e seals private chat messages so the broker only relays
+// ciphertext. Every client has an X25519 identity key, which it publishes
+// through the broker; a private message is a NaCl box between the
+// sender's and the recipient's keys.
+//
+// The broker could hand out a key of its own choosing, so clients pin the
+// first key they see for each user and warn when it changes.
+package e2e
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// A sealed chat body is sealedPrefix followed by the base64 nonce and
+// box. Clients without the key still show something recognisable.
+const sealedPrefix = "/e2e "
+
+const nonceSize = 24
+
+var (
+	ErrBadKey    = errors.New("not a base64 X25519 public key")
+	ErrNotSealed = errors.New("message is not sealed")
+	ErrOpen      = errors.New("message cannot be opened with this key")
+)
+
+// Identity is our key pair
+type Identity struct {
+	public, secret [32]byte
+}
+
+// LoadIdentity reads the secret key kept at path, creating a new one
+// readable only by us when there is none
+func LoadIdentity(path string) (*Identity, error) {
+	id := &Identity{}
+
+	data, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		public, secret, err := box.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		id.public, id.secret = *public, *secret
+		encoded := base64.StdEncoding.EncodeToString(id.secret[:]) + "\n"
+		if err := os.WriteFile(path, []byte(encoded), 0o600); err != nil {
+			return nil, err
+		}
+		return id, nil
+
+	case err != nil:
+		return nil, err
+	}
+
+	secret, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(secret) != 32 {
+		return nil, fmt.Errorf("%s: not a base64 X25519 secret key", path)
+	}
+	copy(id.secret[:], secret)
+	public, err := curve25519.X25519(id.secret[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	copy(id.public[:], public)
+	return id, nil
+}
+
+// Public is our public key as published through the broker
+func (id *Identity) Public() string {
+	return base64.StdEncoding.EncodeToString(id.public[:])
+}
+
+// ParseKey decodes a published public key
+func ParseKey(key string) (*[32]byte, error) {
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(raw) != 32 {
+		return nil, ErrBadKey
+	}
+	var parsed [32]byte
+	copy(parsed[:], raw)
+	return &parsed, nil
+}
+
+// Fingerprint is a short form of a public key for people to compare
+func Fingerprint(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	hexSum := hex.EncodeToString(sum[:8])
+	return hexSum[:4] + " " + hexSum[4:8] + " " + hexSum[8:12] + " " + hexSum[12:]
+}
+
+// IsSealed reports whether a chat body is sealed
+func IsSealed(body string) bool {
+	return strings.HasPrefix(body, sealedPrefix)
+}
+
+// Seal encrypts text for the owner of the public key peer
+func (id *Identity) Seal(text, peer string) (string, error) {
+	peerKey, err := ParseKey(peer)
+	if err != nil {
+		return "", err
+	}
+
+	var nonce [nonceSize]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return "", err
+	}
+	sealed := box.Seal(nonce[:], []byte(text), &nonce, peerKey, &id.secret)
+	return sealedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Open decrypts a body sealed between us and the owner of the public key
+// peer, whichever of the two sealed it
+func (id *Identity) Open(body, peer string) (string, error) {
+	encoded, ok := strings.CutPrefix(body, sealedPrefix)
+	if !ok {
+		return "", ErrNotSealed
+	}
+	peerKey, err := ParseKey(peer)
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < nonceSize+box.Overhead {
+		return "", ErrOpen
+	}
+	var nonce [nonceSize]byte
+	copy(nonce[:], sealed)
+	text, ok := box.Open(nil, sealed[nonceSize:], &nonce, peerKey, &id.secret)
+	if !ok {
+		return "", ErrOpen
+	}
+	return string(text), nil
+}
+
+// KnownKeys pins the public key first seen for each user in a file of
+// "username key" lines
+type KnownKeys struct {
+	path  string
+	mutex sync.Mutex
+	keys  map[string]string
+}
+
+// OpenKnownKeys reads the pinned keys at path. A missing file pins none.
+func OpenKnownKeys(path string) (*KnownKeys, error) {
+	k := &KnownKeys{path: path, keys: make(map[string]string)}
+
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return k, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: want two fields", path, line)
+		}
+		k.keys[fields[0]] = fields[1]
+	}
+	return k, scanner.Err()
+}
+
+// Check compares key with the one pinned for username, pinning it if the
+// user is new to us. It reports false and the pinned key when they
+// differ.
+func (k *KnownKeys) Check(username, key string) (bool, string, error) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	pinned, ok := k.keys[username]
+	if ok {
+		return pinned == key, pinned, nil
+	}
+	k.keys[username] = key
+	return true, key, k.save()
+}
+
+// Pinned returns the key pinned for username, if any
+func (k *KnownKeys) Pinned(username string) (string, bool) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	key, ok := k.keys[username]
+	return key, ok
+}
+
+// Trust pins key for username in place of any earlier one
+func (k *KnownKeys) Trust(username, key string) error {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.keys[username] = key
+	return k.save()
+}
+
+// save rewrites the file through a temporary file, so a crash never
+// leaves it half written
+func (k *KnownKeys) save() error {
+	names := make([]string, 0, len(k.keys))
+	for name := range k.keys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	tmp, err := os.CreateTemp(filepath.Dir(k.path), filepath.Base(k.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	writer := bufio.NewWriter(tmp)
+	for _, name := range names {
+		fmt.Fprintf(writer, "%s %s\n", name, k.keys[name])
+	}
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), k.path)
+}
@@ -0,0 +1,131 @@
+// Package history keeps a durable, size-bounded log of chat messages with
+// one append-only file per room.
+package history
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/maulikxg/ZeroMQ/test/chat/durable"
+)
+
+// Bytes per line besides the message: UTC timestamp, separator and newline
+const lineOverhead = len("2006-01-02T15:04:05Z") + 2
+
+// Entry is one logged message
+type Entry struct {
+	Time    time.Time
+	Message string
+}
+
+// Log appends messages to <dir>/<room>.log. When a file grows past
+// maxBytes it is compacted down to its newest keep entries.
+type Log struct {
+	dir      string
+	maxBytes int64
+	keep     int
+	mutex    sync.Mutex
+}
+
+// Open creates dir if needed and returns a Log writing into it
+func Open(dir string, maxBytes int64, keep int) (*Log, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &Log{dir: dir, maxBytes: maxBytes, keep: keep}, nil
+}
+
+func (l *Log) path(room string) string {
+	return filepath.Join(l.dir, room+".log")
+}
+
+// Append durably records message for room. Messages must not contain
+// newlines; the chat clients read input line by line so they never do.
+func (l *Log) Append(room, message string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	size, err := durable.Append(l.path(room), format(time.Now().UTC(), message), 0o644)
+	if err != nil {
+		return err
+	}
+	if size > l.maxBytes {
+		return l.compact(room)
+	}
+	return nil
+}
+
+// format is the line logged for message
+func format(when time.Time, message string) string {
+	return when.Format(time.RFC3339) + " " + message
+}
+
+// Last returns up to n of the newest entries for room, oldest first
+func (l *Log) Last(room string, n int) ([]Entry, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	entries, err := l.read(room)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) > n {
+		entries = entries[len(entries)-n:]
+	}
+	return entries, nil
+}
+
+// read parses the room's log. Lines that do not parse are skipped
+// rather than failing the whole history.
+func (l *Log) read(room string) ([]Entry, error) {
+	lines, err := durable.ReadLines(l.path(room))
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []Entry
+	for _, line := range lines {
+		stamp, message, ok := strings.Cut(line, " ")
+		if !ok {
+			continue
+		}
+		when, err := time.Parse(time.RFC3339, stamp)
+		if err != nil {
+			continue
+		}
+		entries = append(entries, Entry{Time: when, Message: message})
+	}
+	return entries, nil
+}
+
+// compact rewrites the room file with only its newest entries. Appends
+// wait on the mutex meanwhile, so none is lost with the old file.
+func (l *Log) compact(room string) error {
+	entries, err := l.read(room)
+	if err != nil {
+		return err
+	}
+	if len(entries) > l.keep {
+		entries = entries[len(entries)-l.keep:]
+	}
+
+	// Leave room to grow so long messages don't force a compaction on
+	// every append
+	size := int64(0)
+	for i := len(entries) - 1; i >= 0; i-- {
+		size += int64(len(entries[i].Message) + lineOverhead)
+		if size > l.maxBytes/2 {
+			entries = entries[i+1:]
+			break
+		}
+	}
+
+	lines := make([]string, len(entries))
+	for i, entry := range entries {
+		lines[i] = format(entry.Time, entry.Message)
+	}
+	return durable.WriteLines(l.path(room), lines)
+}
@@ -0,0 +1,92 @@
+// Package limit implements token-bucket rate limits keyed by name, such as
+// a username or a peer address.
+package limit
+
+import (
+	"sync"
+	"time"
+)
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Limiter keeps one token bucket per key. Each bucket holds up to burst
+// tokens and refills at rate tokens per second; every allowed event
+// takes one token.
+type Limiter struct {
+	rate    float64
+	burst   float64
+	buckets map[string]*bucket
+	mutex   sync.Mutex
+}
+
+// New returns a Limiter. A rate of zero or less disables it.
+func New(rate float64, burst int) *Limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &Limiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// Allow takes a token from key's bucket and reports whether there was one
+func (l *Limiter) Allow(key string) bool {
+	if l.rate <= 0 {
+		return true
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	b, ok := l.buckets[key]
+	if !ok {
+		// New keys start with a full bucket
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Forget drops key's bucket
+func (l *Limiter) Forget(key string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	delete(l.buckets, key)
+}
+
+// Prune drops every bucket that has refilled completely, which is the
+// state a new bucket starts in anyway, so memory stays bounded by the
+// number of recently active keys
+func (l *Limiter) Prune() {
+	if l.rate <= 0 {
+		return
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	now := time.Now()
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= full {
+			delete(l.buckets, key)
+		}
+	}
+}
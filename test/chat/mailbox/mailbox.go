@@ -0,0 +1,104 @@
+// Package mailbox durably queues messages for users who are offline, with
+// one append-only file per recipient.
+package mailbox
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/maulikxg/ZeroMQ/test/chat/durable"
+)
+
+// ErrFull is returned when a recipient already has the maximum number of
+// queued messages
+var ErrFull = errors.New("mailbox full")
+
+// Store keeps each recipient's queue in <dir>/<name hash>.queue, one
+// message per line, oldest first
+type Store struct {
+	dir     string
+	maxSize int
+	mutex   sync.Mutex
+}
+
+// Open creates dir if needed and returns a Store holding up to maxSize
+// messages per recipient
+func Open(dir string, maxSize int) (*Store, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &Store{dir: dir, maxSize: maxSize}, nil
+}
+
+// Usernames may contain any printable character, so file names use the
+// hex SHA-256 of the name, which stays well short of the file name limit
+// however many bytes its runes take
+func (s *Store) path(username string) string {
+	sum := sha256.Sum256([]byte(username))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:])+".queue")
+}
+
+// Put durably appends message to username's queue. Messages must not
+// contain newlines.
+func (s *Store) Put(username, message string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	queued, err := s.read(username)
+	if err != nil {
+		return err
+	}
+	if len(queued) >= s.maxSize {
+		return ErrFull
+	}
+
+	_, err = durable.Append(s.path(username), message, 0o600)
+	return err
+}
+
+// Pending returns username's queued messages, oldest first. They stay
+// queued until Keep says otherwise.
+func (s *Store) Pending(username string) ([]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.read(username)
+}
+
+// Keep replaces username's queue with the messages that could not be
+// delivered, or removes it when there are none
+func (s *Store) Keep(username string, undelivered []string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(undelivered) == 0 {
+		err := os.Remove(s.path(username))
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	// A crash while delivering then sends the whole queue again at the
+	// next sign in, never only part of what was left
+	return durable.WriteLines(s.path(username), undelivered)
+}
+
+// read returns username's queue. Empty lines hold no message, so they do
+// not count against the limit.
+func (s *Store) read(username string) ([]string, error) {
+	lines, err := durable.ReadLines(s.path(username))
+	if err != nil {
+		return nil, err
+	}
+	messages := lines[:0]
+	for _, line := range lines {
+		if line != "" {
+			messages = append(messages, line)
+		}
+	}
+	return messages, nil
+}
@@ -0,0 +1,99 @@
+// Example bot for the test/chat broker. It rolls dice for anyone who
+// says "!roll" or "!roll 2d6" in its rooms or privately, and greets
+// people who join.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"strconv"
+	"strings"
+
+	"github.com/maulikxg/ZeroMQ/chat/protocol"
+	"github.com/maulikxg/ZeroMQ/test/chat/bot"
+)
+
+// Largest roll we answer, so nobody asks for a million dice
+const (
+	maxDice  = 20
+	maxSides = 1000
+)
+
+type rollBot struct{}
+
+// parseRoll reads "NdM", "dM" or "" (one six-sided die)
+func parseRoll(spec string) (dice, sides int, ok bool) {
+	if spec == "" {
+		return 1, 6, true
+	}
+	diceText, sidesText, found := strings.Cut(strings.ToLower(spec), "d")
+	if !found {
+		return 0, 0, false
+	}
+	dice = 1
+	if diceText != "" {
+		var err error
+		if dice, err = strconv.Atoi(diceText); err != nil {
+			return 0, 0, false
+		}
+	}
+	sides, err := strconv.Atoi(sidesText)
+	if err != nil || dice < 1 || dice > maxDice || sides < 2 || sides > maxSides {
+		return 0, 0, false
+	}
+	return dice, sides, true
+}
+
+func (rollBot) OnMessage(s *bot.Session, m *protocol.Message) {
+	fields := strings.Fields(m.Body)
+	if len(fields) == 0 || fields[0] != "!roll" {
+		return
+	}
+
+	spec := ""
+	if len(fields) > 1 {
+		spec = fields[1]
+	}
+	dice, sides, ok := parseRoll(spec)
+	if !ok {
+		s.Reply(m, fmt.Sprintf("usage: !roll [NdM], with up to %d dice of up to %d sides", maxDice, maxSides))
+		return
+	}
+
+	rolls := make([]string, dice)
+	total := 0
+	for i := range rolls {
+		n := rand.Intn(sides) + 1
+		rolls[i] = strconv.Itoa(n)
+		total += n
+	}
+	s.Reply(m, fmt.Sprintf("%s rolled %dd%d: %s (total %d)", m.Sender, dice, sides, strings.Join(rolls, " "), total))
+}
+
+func (rollBot) OnJoin(s *bot.Session, room, username string) {
+	s.Send("#"+room, fmt.Sprintf("Welcome, %s! Say !roll to roll a die.", username))
+}
+
+func (rollBot) OnLeave(*bot.Session, string, string) {}
+
+func main() {
+	config := bot.Config{}
+	flag.StringVar(&config.Host, "host", "localhost", "broker host name or address")
+	flag.StringVar(&config.Username, "name", "rollbot", "the bot's username")
+	flag.StringVar(&config.BrokerKey, "broker-key", "", "broker.pub of a CURVE broker; plaintext if empty")
+	flag.StringVar(&config.ClientKey, "key", "", "the bot's .secret key, for brokers that allow-list client keys")
+	flag.StringVar(&config.Password, "password", "", "password, for brokers with PLAIN authentication")
+	rooms := flag.String("rooms", "", "comma-separated rooms to join besides the default one")
+	flag.Parse()
+
+	if *rooms != "" {
+		config.Rooms = strings.Split(*rooms, ",")
+	}
+
+	fmt.Printf("%s is rolling dice, Ctrl-C to stop\n", config.Username)
+	if err := bot.Run(config, rollBot{}); err != nil {
+		log.Fatal(err)
+	}
+}
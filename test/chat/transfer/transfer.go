@@ -0,0 +1,240 @@
+// Package transfer streams files between two chat clients through the
+// broker's data channel, away from the chat sockets so chat stays
+// responsive while a file is on its way.
+//
+// Each side of a transfer uses its own DEALER whose identity is
+// "username/transfer-id". Every message is four frames:
+//
+//	transfer-id | kind | offset | payload
+//
+// The sender keeps at most Window chunks in flight. The receiver writes
+// chunks in order and answers each with an ACK holding the number of
+// bytes it has so far, so a lost or reordered chunk is simply sent again.
+package transfer
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	zmq "github.com/pebbe/zmq4"
+)
+
+// Largest payload of a single DATA frame
+const ChunkSize = 64 << 10
+
+// Chunks the sender may have in flight before it waits for an ACK
+const Window = 8
+
+// Frame kinds
+const (
+	Data  = "DATA"
+	Ack   = "ACK"
+	Abort = "ABORT"
+)
+
+// How long to wait for the peer before resending, and before giving up
+const (
+	retryInterval = 2 * time.Second
+	idleTimeout   = 30 * time.Second
+)
+
+var ErrMalformed = errors.New("malformed transfer frame")
+
+// Frame is one message on the data channel
+type Frame struct {
+	ID      string
+	Kind    string
+	Offset  int64
+	Payload string
+}
+
+// Parts encodes f for SendMessage after any routing frames
+func (f *Frame) Parts(prefix ...string) []interface{} {
+	parts := make([]interface{}, 0, len(prefix)+4)
+	for _, frame := range prefix {
+		parts = append(parts, frame)
+	}
+	return append(parts, f.ID, f.Kind, strconv.FormatInt(f.Offset, 10), f.Payload)
+}
+
+// Decode parses the four frames of a data channel message
+func Decode(frames []string) (*Frame, error) {
+	if len(frames) != 4 {
+		return nil, fmt.Errorf("%w: got %d frames, want 4", ErrMalformed, len(frames))
+	}
+	offset, err := strconv.ParseInt(frames[2], 10, 64)
+	if err != nil || offset < 0 {
+		return nil, fmt.Errorf("%w: bad offset %q", ErrMalformed, frames[2])
+	}
+	return &Frame{ID: frames[0], Kind: frames[1], Offset: offset, Payload: frames[3]}, nil
+}
+
+// Identity is the data channel identity of username's side of transfer id
+func Identity(username, id string) string {
+	return username + "/" + id
+}
+
+// ParseIdentity splits a data channel identity. Usernames may contain
+// '/', transfer IDs may not.
+func ParseIdentity(identity string) (username, id string, ok bool) {
+	i := strings.LastIndex(identity, "/")
+	if i <= 0 || i == len(identity)-1 {
+		return "", "", false
+	}
+	return identity[:i], identity[i+1:], true
+}
+
+// Progress is told how many of total bytes have arrived so far
+type Progress func(done, total int64)
+
+func send(socket *zmq.Socket, f *Frame) error {
+	_, err := socket.SendMessage(f.Parts()...)
+	return err
+}
+
+// recv waits up to retryInterval for a frame of transfer id. It returns
+// nil without an error when nothing arrived.
+func recv(socket *zmq.Socket, id string) (*Frame, error) {
+	poller := zmq.NewPoller()
+	poller.Add(socket, zmq.POLLIN)
+	polled, err := poller.Poll(retryInterval)
+	if err != nil || len(polled) == 0 {
+		return nil, err
+	}
+
+	frames, err := socket.RecvMessage(0)
+	if err != nil {
+		return nil, err
+	}
+	f, err := Decode(frames)
+	if err != nil || f.ID != id {
+		// Not ours; treat it like silence
+		return nil, nil
+	}
+	if f.Kind == Abort {
+		return nil, fmt.Errorf("aborted by peer: %s", f.Payload)
+	}
+	return f, nil
+}
+
+// Send streams size bytes of file as transfer id and returns once the
+// receiver has acknowledged all of them
+func Send(socket *zmq.Socket, id string, file *os.File, size int64, progress Progress) error {
+	buffer := make([]byte, ChunkSize)
+	var acked, next int64
+	lastHeard := time.Now()
+
+	for acked < size {
+		// Fill the window
+		for next < size && next-acked < Window*ChunkSize {
+			n, err := file.ReadAt(buffer, next)
+			if n == 0 && err != nil {
+				Cancel(socket, id, "read failed")
+				return fmt.Errorf("reading at offset %d: %w", next, err)
+			}
+			if err := send(socket, &Frame{ID: id, Kind: Data, Offset: next, Payload: string(buffer[:n])}); err != nil {
+				return err
+			}
+			next += int64(n)
+		}
+
+		f, err := recv(socket, id)
+		if err != nil {
+			return err
+		}
+		if f == nil {
+			if time.Since(lastHeard) > idleTimeout {
+				Cancel(socket, id, "timed out")
+				return fmt.Errorf("no answer from the receiver for %v", idleTimeout)
+			}
+			// Go back to the first unacknowledged chunk
+			next = acked
+			continue
+		}
+
+		lastHeard = time.Now()
+		if f.Kind == Ack && f.Offset > acked && f.Offset <= size {
+			acked = f.Offset
+			if next < acked {
+				next = acked
+			}
+			progress(acked, size)
+		}
+	}
+	return nil
+}
+
+// Receive writes transfer id into path. The data goes to a temporary file
+// next to path that only takes its place once complete and synced.
+func Receive(socket *zmq.Socket, id, path string, size int64, progress Progress) error {
+	part, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.part")
+	if err != nil {
+		Cancel(socket, id, "cannot create file")
+		return err
+	}
+	defer os.Remove(part.Name())
+	defer part.Close()
+
+	// The first ACK also tells the sender we are listening
+	var received int64
+	lastHeard := time.Now()
+	ack := func() error {
+		return send(socket, &Frame{ID: id, Kind: Ack, Offset: received})
+	}
+	if err := ack(); err != nil {
+		return err
+	}
+
+	for received < size {
+		f, err := recv(socket, id)
+		if err != nil {
+			return err
+		}
+		if f == nil {
+			if time.Since(lastHeard) > idleTimeout {
+				Cancel(socket, id, "timed out")
+				return fmt.Errorf("no data from the sender for %v", idleTimeout)
+			}
+			if err := ack(); err != nil {
+				return err
+			}
+			continue
+		}
+
+		lastHeard = time.Now()
+		if f.Kind != Data {
+			continue
+		}
+		if f.Offset == received && received+int64(len(f.Payload)) <= size {
+			if _, err := part.WriteString(f.Payload); err != nil {
+				Cancel(socket, id, "write failed")
+				return err
+			}
+			received += int64(len(f.Payload))
+			progress(received, size)
+		}
+		// Out of order chunks are dropped; the ACK makes the sender
+		// go back to the one we are missing
+		if err := ack(); err != nil {
+			return err
+		}
+	}
+
+	if err := part.Sync(); err != nil {
+		return err
+	}
+	if err := part.Close(); err != nil {
+		return err
+	}
+	return os.Rename(part.Name(), path)
+}
+
+// Cancel tells the peer that transfer id is abandoned
+func Cancel(socket *zmq.Socket, id, reason string) {
+	send(socket, &Frame{ID: id, Kind: Abort, Payload: reason})
+}
@@ -0,0 +1,816 @@
+// Package filetransfer moves a file from the push programs in test/maxmsg
+// and test/utf16 to their pull counterparts with credit-based flow
+// control.
+//
+// The sender binds a ROUTER, and the receiver connects one or more
+// DEALERs to it, each a stream of its own. Each stream starts by granting
+// the sender credit for as many chunks as it is willing to have in
+// flight, and grants one more for every chunk that arrives. The sender
+// never sends a chunk it has no credit for, so neither side ever holds
+// more than the pipeline depth per stream in memory, however fast the
+// link or slow the disk. Every resume grants a stream its credit afresh,
+// so the sender answers each grant with GRANTED, and the receiver returns
+// no credit for chunks that arrive on a stream before that: they were
+// sent on the credit the grant replaced. Every message is four frames
+// after the ROUTER's identity frame:
+//
+//	kind | offset | checksum | payload
+//
+// With several streams, each a TCP connection of its own, chunks travel
+// side by side and arrive out of order. Every chunk carries its offset,
+// so the receiver writes it straight to its place in the file.
+//
+// A transfer is a HEADER describing the file, its DATA chunks and an EOF.
+// Every chunk carries its CRC32C, and the receiver asks again for any that
+// arrives damaged. The EOF carries the SHA-256 of the whole file, which
+// the receiver checks against what it wrote before telling the sender it
+// is done and putting the file in place with the sender's permissions and
+// modification time.
+//
+// Transfers survive either side restarting. The receiver keeps a
+// checkpoint file with the length of the prefix it has synced to disk,
+// and opens every transfer with a RESUME from that offset; it resumes
+// again whenever the sender falls silent, which is how a restarted sender
+// learns where to pick up.
+//
+// A sender serves one receiver at a time. It answers a second one with
+// BUSY, until the first has been silent long enough to have gone. A
+// receiver told BUSY keeps asking, which is how a restarted one gets
+// back in once its old session has expired.
+package filetransfer
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	zmq "github.com/pebbe/zmq4"
+)
+
+// Defaults for the programs' -chunk, -pipeline and -streams flags
+const (
+	DefaultChunkSize = 1 << 20
+	DefaultPipeline  = 16
+	DefaultStreams   = 4
+)
+
+// Frame kinds
+const (
+	// Receiver to sender: send the header, then start over at offset with
+	// the chunks of credit in the payload. The offset is the receiver's
+	// checkpoint. The first RESUME asks for the header alone, as the
+	// receiver needs the file's name to find its checkpoint. From the
+	// receiver, the checksum frame carries its session, which its streams
+	// share.
+	Resume = "RESUME"
+
+	// Receiver to sender, on every stream but the one that resumes: this
+	// stream takes chunks too, with the chunks of credit in the payload
+	Join = "JOIN"
+
+	// Sender to receiver, in answer to a RESUME or JOIN: the stream's
+	// credit is now what that asked for. A RESUME or JOIN payload is its
+	// credit and an epoch separated by a space, and the offset of the
+	// GRANTED is that epoch.
+	Granted = "GRANTED"
+
+	// Receiver to sender: the chunk at offset arrived damaged
+	Retry = "RETRY"
+
+	// Sender to receiver: payload is the JSON of a Header
+	HeaderKind = "HEADER"
+
+	// Receiver to sender: payload is a number of further chunks. The
+	// offset is how much of the file the receiver has.
+	Credit = "CREDIT"
+
+	// Sender to receiver: payload is the part of the file at offset, the
+	// checksum its CRC32C
+	Data = "DATA"
+
+	// Sender to receiver after the last chunk: the offset is the file's
+	// size, the checksum its SHA-256
+	EOF = "EOF"
+
+	// Receiver to sender: the file was checked against the EOF's
+	// checksum. The payload is Match or Mismatch.
+	Done = "DONE"
+
+	// Sender to receiver: another receiver's transfer is under way
+	Busy = "BUSY"
+)
+
+// The checksums in DATA and EOF frames, as named in the header
+const ChecksumAlgorithm = "crc32c+sha256"
+
+// Payloads of a DONE
+const (
+	Match    = "match"
+	Mismatch = "mismatch"
+)
+
+// Times a chunk may arrive damaged before the receiver gives up on it
+const maxRetries = 5
+
+// How often the receiver syncs and checkpoints, and how long it waits for
+// a silent sender before asking it to resume. A receiver resumes at
+// least that often, so the sender takes one silent for twice as long to
+// have gone.
+const (
+	checkpointInterval = time.Second
+	idleTimeout        = 5 * time.Second
+	sessionTimeout     = 2 * idleTimeout
+)
+
+var (
+	ErrMalformed = errors.New("malformed transfer frame")
+	ErrChanged   = errors.New("the file or its chunk size changed on the sender during the transfer")
+	ErrCorrupt   = errors.New("chunk keeps arriving damaged")
+	ErrMismatch  = errors.New("received file does not match the sender's")
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Checksum is the CRC32C of a chunk as carried in DATA frames
+func Checksum(chunk []byte) string {
+	return fmt.Sprintf("%08x", crc32.Checksum(chunk, castagnoli))
+}
+
+// Frame is one transfer message
+type Frame struct {
+	Kind     string
+	Offset   int64
+	Checksum string
+	Payload  []byte
+}
+
+// Parts encodes f for SendMessage after any routing frames
+func (f *Frame) Parts(prefix ...string) []interface{} {
+	parts := make([]interface{}, 0, len(prefix)+4)
+	for _, frame := range prefix {
+		parts = append(parts, frame)
+	}
+	return append(parts, f.Kind, strconv.FormatInt(f.Offset, 10), f.Checksum, f.Payload)
+}
+
+// Decode parses the four frames of a transfer message
+func Decode(frames [][]byte) (*Frame, error) {
+	if len(frames) != 4 {
+		return nil, fmt.Errorf("%w: got %d frames, want 4", ErrMalformed, len(frames))
+	}
+	offset, err := strconv.ParseInt(string(frames[1]), 10, 64)
+	if err != nil || offset < 0 {
+		return nil, fmt.Errorf("%w: bad offset %q", ErrMalformed, frames[1])
+	}
+	return &Frame{Kind: string(frames[0]), Offset: offset, Checksum: string(frames[2]), Payload: frames[3]}, nil
+}
+
+// Header describes the file being sent
+type Header struct {
+	Name      string      `json:"name"`
+	Size      int64       `json:"size"`
+	Mode      os.FileMode `json:"mode"`
+	ModTime   time.Time   `json:"mtime"`
+	ChunkSize int         `json:"chunk_size"`
+	Checksum  string      `json:"checksum"`
+}
+
+// Same reports whether h and other describe the same version of a file,
+// cut into chunks of the same size
+func (h *Header) Same(other *Header) bool {
+	return h.Name == other.Name && h.Size == other.Size && h.ModTime.Equal(other.ModTime) &&
+		h.ChunkSize == other.ChunkSize
+}
+
+// Digest is the SHA-256 of the first size bytes of r, as carried in the
+// EOF
+func Digest(r io.ReaderAt, size int64) (string, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, io.NewSectionReader(r, 0, size)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// count parses the chunk count in a CREDIT payload
+func count(f *Frame) (int, error) {
+	n, err := strconv.Atoi(string(f.Payload))
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%w: bad count %q", ErrMalformed, f.Payload)
+	}
+	return n, nil
+}
+
+// grant parses the chunk count and epoch in a RESUME or JOIN payload
+func grant(f *Frame) (int, int64, error) {
+	countText, epochText, _ := strings.Cut(string(f.Payload), " ")
+	n, err := strconv.Atoi(countText)
+	if err != nil || n < 0 {
+		return 0, 0, fmt.Errorf("%w: bad count %q", ErrMalformed, f.Payload)
+	}
+	epoch, err := strconv.ParseInt(epochText, 10, 64)
+	if err != nil || epoch < 0 {
+		return 0, 0, fmt.Errorf("%w: bad epoch %q", ErrMalformed, f.Payload)
+	}
+	return n, epoch, nil
+}
+
+// Sender serves a file to one receiver at a time on a ROUTER socket,
+// turning away any other while that one is heard from. The receiver may
+// connect several streams, which share the chunks between them.
+type Sender struct {
+	Socket    *zmq.Socket
+	ChunkSize int
+
+	// Sent, if set, is told about every chunk sent
+	Sent func(offset int64, size int)
+
+	header []byte // the JSON of the file's Header
+	size   int64
+
+	session string         // the receiver's, from its RESUME or JOIN
+	heard   time.Time      // when the receiver last sent anything
+	streams map[string]int // the credit of each of its streams
+	lead    string         // the stream that resumes, which gets the EOF
+	resumed bool           // whether the lead has said where to start
+	next    int64          // offset of the next chunk to send
+	retries []int64        // chunks that arrived damaged, to send again
+	eofSent bool
+	verdict string // the receiver's DONE, once it has checked the file
+}
+
+// send sends a frame to one of the receiver's streams. A stream that has
+// gone is not an error; it resumes when it comes back.
+func (s *Sender) send(stream string, f *Frame) (bool, error) {
+	_, err := s.Socket.SendMessage(f.Parts(stream)...)
+	if zmq.AsErrno(err) == zmq.EHOSTUNREACH {
+		delete(s.streams, stream)
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// handle applies a message from the receiver. A RESUME or JOIN from
+// another session is a new receiver. It replaces the old one once that
+// has gone silent, and is told BUSY until then.
+func (s *Sender) handle(frames [][]byte) error {
+	if len(frames) < 1 {
+		return ErrMalformed
+	}
+	f, err := Decode(frames[1:])
+	if err != nil {
+		return err
+	}
+
+	stream, session := string(frames[0]), f.Checksum
+	if (f.Kind == Resume || f.Kind == Join) && session != s.session {
+		if s.session != "" && time.Since(s.heard) < sessionTimeout {
+			if _, err := s.send(stream, &Frame{Kind: Busy}); err != nil {
+				return fmt.Errorf("sending busy: %w", err)
+			}
+			return nil
+		}
+		s.session, s.streams, s.retries = session, make(map[string]int), nil
+		s.lead, s.resumed = "", false
+	}
+	if session != s.session {
+		return nil
+	}
+	s.heard = time.Now()
+
+	switch f.Kind {
+	case Resume:
+		n, epoch, err := grant(f)
+		if err != nil {
+			return err
+		}
+		s.streams[stream], s.lead, s.resumed = n, stream, true
+		s.next, s.eofSent = f.Offset, false
+		if _, err := s.send(stream, &Frame{Kind: HeaderKind, Payload: s.header}); err != nil {
+			return fmt.Errorf("sending header: %w", err)
+		}
+		if _, err := s.send(stream, &Frame{Kind: Granted, Offset: epoch}); err != nil {
+			return fmt.Errorf("sending grant: %w", err)
+		}
+
+	case Join:
+		n, epoch, err := grant(f)
+		if err != nil {
+			return err
+		}
+		s.streams[stream] = n
+		if _, err := s.send(stream, &Frame{Kind: Granted, Offset: epoch}); err != nil {
+			return fmt.Errorf("sending grant: %w", err)
+		}
+
+	case Credit:
+		n, err := count(f)
+		if err != nil {
+			return err
+		}
+		if _, ok := s.streams[stream]; ok {
+			s.streams[stream] += n
+		}
+
+	case Retry:
+		if f.Offset < s.size {
+			s.retries = append(s.retries, f.Offset)
+		}
+
+	case Done:
+		s.verdict = string(f.Payload)
+	}
+	return nil
+}
+
+// ready picks the stream with the most credit, which spreads the chunks
+// evenly over the streams
+func (s *Sender) ready() string {
+	best, most := "", 0
+	for stream, credit := range s.streams {
+		if credit > most {
+			best, most = stream, credit
+		}
+	}
+	return best
+}
+
+// chunk picks the offset of the next chunk to send: one that arrived
+// damaged, or else the next one in the file
+func (s *Sender) chunk() (int64, bool) {
+	if !s.resumed {
+		return 0, false
+	}
+	if len(s.retries) > 0 {
+		offset := s.retries[0]
+		s.retries = s.retries[1:]
+		return offset, true
+	}
+	if s.next < s.size {
+		offset := s.next
+		s.next = min(s.next+int64(s.ChunkSize), s.size)
+		return offset, true
+	}
+	return 0, false
+}
+
+// Send streams file and returns once the receiver has checked all of it
+// against the EOF's checksum. It waits for a receiver to come back
+// however long that takes. The file is hashed first, which for a large
+// file takes a while.
+func (s *Sender) Send(file *os.File) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	s.size = info.Size()
+	s.header, err = json.Marshal(&Header{
+		Name:      filepath.Base(file.Name()),
+		Size:      s.size,
+		Mode:      info.Mode().Perm(),
+		ModTime:   info.ModTime(),
+		ChunkSize: s.ChunkSize,
+		Checksum:  ChecksumAlgorithm,
+	})
+	if err != nil {
+		return err
+	}
+	digest, err := Digest(file, s.size)
+	if err != nil {
+		return fmt.Errorf("hashing: %w", err)
+	}
+
+	buffer := make([]byte, s.ChunkSize)
+	for s.verdict == "" {
+		for stream := s.ready(); stream != ""; stream = s.ready() {
+			offset, ok := s.chunk()
+			if !ok {
+				break
+			}
+			n, err := file.ReadAt(buffer, offset)
+			if n == 0 && err != nil {
+				return fmt.Errorf("reading at offset %d: %w", offset, err)
+			}
+			sent, err := s.send(stream, &Frame{Kind: Data, Offset: offset, Checksum: Checksum(buffer[:n]), Payload: buffer[:n]})
+			if err != nil {
+				return fmt.Errorf("sending offset %d: %w", offset, err)
+			}
+			if !sent {
+				// Another stream takes it
+				s.retries = append(s.retries, offset)
+				continue
+			}
+			if s.Sent != nil {
+				s.Sent(offset, n)
+			}
+			s.streams[stream]--
+		}
+		if _, ok := s.streams[s.lead]; ok && s.resumed && s.next >= s.size && len(s.retries) == 0 && !s.eofSent {
+			if s.eofSent, err = s.send(s.lead, &Frame{Kind: EOF, Offset: s.size, Checksum: digest}); err != nil {
+				return fmt.Errorf("sending EOF: %w", err)
+			}
+		}
+
+		frames, err := s.Socket.RecvMessageBytes(0)
+		if err != nil {
+			return err
+		}
+		if err := s.handle(frames); err != nil {
+			// A confused receiver should not stop the transfer
+			if !errors.Is(err, ErrMalformed) {
+				return err
+			}
+			continue
+		}
+	}
+	if s.verdict != Match {
+		return ErrMismatch
+	}
+	return nil
+}
+
+// Receiver takes a file from the sender on one or more DEALER sockets,
+// each a stream of its own, and saves it in Dir under the name in the
+// header
+type Receiver struct {
+	Sockets  []*zmq.Socket
+	Pipeline int // chunks in flight on each stream
+	Dir      string
+
+	// Received, if set, is told about every chunk written
+	Received func(offset int64, size int)
+
+	// Waiting, if set, is told every time the sender answers BUSY
+	Waiting func()
+}
+
+// LoadCheckpoint reads the offset saved at path for the file h describes.
+// A missing file, or one saved for another version of the file, is a
+// transfer that has not started.
+func LoadCheckpoint(path string, h *Header) (int64, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var offset, size, mtime int64
+	if _, err := fmt.Sscan(string(data), &offset, &size, &mtime); err != nil || offset < 0 {
+		return 0, fmt.Errorf("%s: not a checkpoint", path)
+	}
+	if size != h.Size || mtime != h.ModTime.UnixNano() || offset > size {
+		return 0, nil
+	}
+	return offset, nil
+}
+
+// saveCheckpoint writes offset to path through a temporary file, so a
+// crash leaves the old checkpoint or the new one
+func saveCheckpoint(path string, offset int64, h *Header) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := fmt.Fprintln(tmp, offset, h.Size, h.ModTime.UnixNano()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// syncDir makes a rename in dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// incoming is the receiver's side of a transfer
+type incoming struct {
+	*Receiver
+	session string
+
+	header *Header  // nil until the sender sent it
+	path   string   // where the file goes once verified
+	file   *os.File // path + ".part" while the file arrives
+
+	// The file is complete up to written. Chunks past it that arrived
+	// ahead of the ones before them are written already and remembered
+	// here by offset, with their length, until the gap closes.
+	written int64
+	ahead   map[int64]int
+
+	// Each resume is a new epoch. A stream gets credit back only for
+	// chunks that arrive after the GRANTED of the latest one.
+	epoch   int64
+	granted map[*zmq.Socket]int64
+
+	checkpointed int64
+	damaged      map[int64]int // how often each chunk arrived damaged
+	eof          *Frame        // the EOF, once it came
+}
+
+func (in *incoming) send(socket *zmq.Socket, kind string, offset int64, payload string) error {
+	f := &Frame{Kind: kind, Offset: offset, Checksum: in.session, Payload: []byte(payload)}
+	_, err := socket.SendMessage(f.Parts()...)
+	return err
+}
+
+// resume asks the sender for everything after what we have, and puts
+// the other streams back to work, or asks for just the header while we do
+// not know the file
+func (in *incoming) resume() error {
+	in.epoch++
+	epoch := strconv.FormatInt(in.epoch, 10)
+	if in.header == nil {
+		return in.send(in.Sockets[0], Resume, 0, "0 "+epoch)
+	}
+	credit := strconv.Itoa(in.Pipeline) + " " + epoch
+	if err := in.send(in.Sockets[0], Resume, in.written, credit); err != nil {
+		return err
+	}
+	for _, socket := range in.Sockets[1:] {
+		if err := in.send(socket, Join, in.written, credit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// start opens the file a header describes and picks up at its
+// checkpoint. Anything past the checkpoint was never synced, so it is
+// thrown away. The sender repeats the header on every resume.
+func (in *incoming) start(f *Frame) error {
+	h := &Header{}
+	if err := json.Unmarshal(f.Payload, h); err != nil {
+		return fmt.Errorf("%w: bad header: %v", ErrMalformed, err)
+	}
+	if in.header != nil {
+		if !in.header.Same(h) {
+			return ErrChanged
+		}
+		return nil
+	}
+
+	name := filepath.Base(h.Name)
+	if name == "." || name == ".." || name == string(filepath.Separator) || h.Size < 0 || h.ChunkSize <= 0 {
+		return fmt.Errorf("%w: bad header for %q", ErrMalformed, h.Name)
+	}
+	if h.Checksum != ChecksumAlgorithm {
+		return fmt.Errorf("unsupported checksum %q", h.Checksum)
+	}
+	h.Name = name
+
+	if err := os.MkdirAll(in.Dir, 0o755); err != nil {
+		return err
+	}
+	in.path = filepath.Join(in.Dir, name)
+	file, err := os.OpenFile(in.path+".part", os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return err
+	}
+	in.file = file
+
+	if in.written, err = LoadCheckpoint(in.path+".checkpoint", h); err != nil {
+		return err
+	}
+	if err := in.file.Truncate(in.written); err != nil {
+		return err
+	}
+	in.header, in.checkpointed = h, in.written
+	return in.resume()
+}
+
+// checkpoint syncs what has been written and records the complete prefix
+func (in *incoming) checkpoint() error {
+	if in.checkpointed == in.written {
+		return nil
+	}
+	if err := in.file.Sync(); err != nil {
+		return err
+	}
+	if err := saveCheckpoint(in.path+".checkpoint", in.written, in.header); err != nil {
+		return err
+	}
+	in.checkpointed = in.written
+	return nil
+}
+
+// data writes a chunk in its place, unless we have it already, and asks
+// again for it if it is damaged. The credit goes back on the stream the
+// chunk came on, unless the chunk was sent before the stream's latest
+// grant, which the sender does not count it against.
+func (in *incoming) data(socket *zmq.Socket, f *Frame) error {
+	_, isAhead := in.ahead[f.Offset]
+	switch {
+	case len(f.Payload) > in.header.ChunkSize || f.Offset+int64(len(f.Payload)) > in.header.Size:
+		// Not part of this file
+
+	case f.Offset < in.written || isAhead:
+		// Sent again after a resume
+
+	case Checksum(f.Payload) != f.Checksum:
+		in.damaged[f.Offset]++
+		if in.damaged[f.Offset] > maxRetries {
+			return fmt.Errorf("%w: offset %d", ErrCorrupt, f.Offset)
+		}
+		if err := in.send(socket, Retry, f.Offset, ""); err != nil {
+			return err
+		}
+
+	default:
+		if _, err := in.file.WriteAt(f.Payload, f.Offset); err != nil {
+			return fmt.Errorf("writing at offset %d: %w", f.Offset, err)
+		}
+		delete(in.damaged, f.Offset)
+		in.ahead[f.Offset] = len(f.Payload)
+		for n, ok := in.ahead[in.written]; ok; n, ok = in.ahead[in.written] {
+			delete(in.ahead, in.written)
+			in.written += int64(n)
+		}
+		if in.Received != nil {
+			in.Received(f.Offset, len(f.Payload))
+		}
+	}
+	if in.granted[socket] != in.epoch {
+		return nil
+	}
+	return in.send(socket, Credit, in.written, "1")
+}
+
+// finish checks the file against the EOF's checksum. A good file is put
+// in place with the sender's permissions and modification time; a bad one
+// is thrown away, to be sent again from the start. Either way the sender
+// is told the verdict.
+func (in *incoming) finish() error {
+	if err := in.checkpoint(); err != nil {
+		return fmt.Errorf("checkpointing: %w", err)
+	}
+	digest, err := Digest(in.file, in.header.Size)
+	if err != nil {
+		return fmt.Errorf("hashing: %w", err)
+	}
+	part := in.file.Name()
+
+	if digest != in.eof.Checksum {
+		in.send(in.Sockets[0], Done, in.eof.Offset, Mismatch)
+		in.file.Close()
+		in.file = nil
+		os.Remove(part)
+		os.Remove(in.path + ".checkpoint")
+		return fmt.Errorf("%w: SHA-256 %s, want %s", ErrMismatch, digest, in.eof.Checksum)
+	}
+
+	if err := in.file.Chmod(in.header.Mode.Perm()); err != nil {
+		return err
+	}
+	if err := in.file.Sync(); err != nil {
+		return err
+	}
+	err = in.file.Close()
+	in.file = nil
+	if err != nil {
+		return err
+	}
+	if err := os.Chtimes(part, time.Now(), in.header.ModTime); err != nil {
+		return err
+	}
+	if err := os.Rename(part, in.path); err != nil {
+		return err
+	}
+	if err := syncDir(in.Dir); err != nil {
+		return err
+	}
+	if err := os.Remove(in.path + ".checkpoint"); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return in.send(in.Sockets[0], Done, in.eof.Offset, Match)
+}
+
+// newSession names a receiver to the sender, so it can tell our streams
+// from those of a receiver before us
+func newSession() (string, error) {
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id[:]), nil
+}
+
+// Receive takes one file from the sender and returns its header once the
+// file is verified and in place
+func (r *Receiver) Receive() (*Header, error) {
+	if len(r.Sockets) == 0 {
+		return nil, errors.New("no sockets to receive on")
+	}
+	session, err := newSession()
+	if err != nil {
+		return nil, err
+	}
+	in := &incoming{
+		Receiver: r,
+		session:  session,
+		ahead:    make(map[int64]int),
+		granted:  make(map[*zmq.Socket]int64),
+		damaged:  make(map[int64]int),
+	}
+	defer func() {
+		if in.file != nil {
+			in.file.Close()
+		}
+	}()
+	if err := in.resume(); err != nil {
+		return nil, err
+	}
+
+	poller := zmq.NewPoller()
+	for _, socket := range r.Sockets {
+		poller.Add(socket, zmq.POLLIN)
+	}
+	lastHeard, lastCheckpoint := time.Now(), time.Now()
+	for {
+		if in.file != nil && time.Since(lastCheckpoint) >= checkpointInterval {
+			if err := in.checkpoint(); err != nil {
+				return nil, fmt.Errorf("checkpointing: %w", err)
+			}
+			lastCheckpoint = time.Now()
+		}
+
+		polled, err := poller.Poll(checkpointInterval)
+		if err != nil {
+			return nil, err
+		}
+		if len(polled) == 0 {
+			// The sender may have restarted, or a chunk got lost
+			if time.Since(lastHeard) > idleTimeout {
+				if err := in.resume(); err != nil {
+					return nil, err
+				}
+				lastHeard = time.Now()
+			}
+			continue
+		}
+		lastHeard = time.Now()
+
+		for _, item := range polled {
+			frames, err := item.Socket.RecvMessageBytes(0)
+			if err != nil {
+				return nil, err
+			}
+			f, err := Decode(frames)
+			if err != nil {
+				continue
+			}
+
+			switch {
+			case f.Kind == Busy:
+				// Another receiver, or our own before a restart, holds the
+				// sender. We resume again once it falls silent, until that
+				// session expires.
+				if r.Waiting != nil {
+					r.Waiting()
+				}
+			case f.Kind == HeaderKind:
+				err = in.start(f)
+			case f.Kind == Granted:
+				in.granted[item.Socket] = f.Offset
+			case f.Kind == Data && in.header != nil:
+				err = in.data(item.Socket, f)
+			case f.Kind == EOF && in.header != nil && f.Offset == in.header.Size:
+				// Chunks sent before it may still be on other streams
+				in.eof = f
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if in.eof != nil && in.written == in.header.Size {
+			return in.header, in.finish()
+		}
+	}
+}
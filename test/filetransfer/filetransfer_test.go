@@ -0,0 +1,356 @@
+package filetransfer
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"syscall"
+	"testing"
+	"time"
+
+	zmq "github.com/pebbe/zmq4"
+)
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name    string
+		frames  []string
+		want    *Frame
+		wantErr bool
+	}{
+		{
+			name:   "data",
+			frames: []string{Data, "1048576", "deadbeef", "chunk"},
+			want:   &Frame{Kind: Data, Offset: 1 << 20, Checksum: "deadbeef", Payload: []byte("chunk")},
+		},
+		{
+			name:   "empty payload",
+			frames: []string{Credit, "0", "session", ""},
+			want:   &Frame{Kind: Credit, Checksum: "session", Payload: []byte{}},
+		},
+		{name: "too few frames", frames: []string{Data, "0", "deadbeef"}, wantErr: true},
+		{name: "too many frames", frames: []string{Data, "0", "deadbeef", "chunk", "more"}, wantErr: true},
+		{name: "offset not a number", frames: []string{Data, "ten", "deadbeef", "chunk"}, wantErr: true},
+		{name: "negative offset", frames: []string{Data, "-1", "deadbeef", "chunk"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frames := make([][]byte, len(tt.frames))
+			for i, frame := range tt.frames {
+				frames[i] = []byte(frame)
+			}
+			got, err := Decode(frames)
+			if tt.wantErr {
+				if !errors.Is(err, ErrMalformed) {
+					t.Fatalf("Decode: %v, want ErrMalformed", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Decode: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Decode = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadCheckpoint(t *testing.T) {
+	mtime := time.Unix(1700000000, 123)
+	header := &Header{Name: "file", Size: 100, ModTime: mtime, ChunkSize: 10}
+
+	tests := []struct {
+		name     string
+		contents *string // nil for no checkpoint file
+		want     int64
+		wantErr  bool
+	}{
+		{name: "no checkpoint", want: 0},
+		{name: "same file", contents: ptr(fmt.Sprintln(40, 100, mtime.UnixNano())), want: 40},
+		{name: "complete", contents: ptr(fmt.Sprintln(100, 100, mtime.UnixNano())), want: 100},
+		{name: "file grew", contents: ptr(fmt.Sprintln(40, 90, mtime.UnixNano())), want: 0},
+		{name: "file touched", contents: ptr(fmt.Sprintln(40, 100, mtime.UnixNano()+1)), want: 0},
+		{name: "past the end", contents: ptr(fmt.Sprintln(110, 100, mtime.UnixNano())), want: 0},
+		{name: "negative offset", contents: ptr(fmt.Sprintln(-1, 100, mtime.UnixNano())), wantErr: true},
+		{name: "garbage", contents: ptr("not a checkpoint\n"), wantErr: true},
+		{name: "empty", contents: ptr(""), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "file.checkpoint")
+			if tt.contents != nil {
+				if err := os.WriteFile(path, []byte(*tt.contents), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got, err := LoadCheckpoint(path, header)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("LoadCheckpoint = %d, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadCheckpoint: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("LoadCheckpoint = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSaveCheckpoint(t *testing.T) {
+	header := &Header{Name: "file", Size: 100, ModTime: time.Unix(1700000000, 123), ChunkSize: 10}
+	path := filepath.Join(t.TempDir(), "file.checkpoint")
+	for _, offset := range []int64{30, 60} {
+		if err := saveCheckpoint(path, offset, header); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := LoadCheckpoint(path, header); err != nil || got != offset {
+			t.Errorf("LoadCheckpoint after saving %d = %d, %v", offset, got, err)
+		}
+	}
+}
+
+func ptr(s string) *string {
+	return &s
+}
+
+// The file received in TestIncomingData, in chunks at 0, 4 and 8
+const contents = "0123456789"
+
+// newIncoming returns a receiver's side of a transfer of contents, past
+// its header, whose replies arrive on the returned socket
+func newIncoming(t *testing.T) (*incoming, *zmq.Socket) {
+	t.Helper()
+	context, err := zmq.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoint := "inproc://" + t.Name()
+	stream, err := context.NewSocket(zmq.PAIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Bind(endpoint); err != nil {
+		t.Fatal(err)
+	}
+	sender, err := context.NewSocket(zmq.PAIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sender.Connect(endpoint); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		stream.SetLinger(0)
+		sender.SetLinger(0)
+		stream.Close()
+		sender.Close()
+		context.Term()
+	})
+
+	file, err := os.Create(filepath.Join(t.TempDir(), "file.part"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { file.Close() })
+
+	in := &incoming{
+		Receiver: &Receiver{Sockets: []*zmq.Socket{stream}, Pipeline: 4},
+		session:  "session",
+		header:   &Header{Name: "file", Size: int64(len(contents)), ChunkSize: 4, Checksum: ChecksumAlgorithm},
+		file:     file,
+		ahead:    make(map[int64]int),
+		epoch:    1,
+		granted:  map[*zmq.Socket]int64{stream: 1},
+		damaged:  make(map[int64]int),
+	}
+	return in, sender
+}
+
+// chunk is the DATA frame for contents at offset, or for payload there
+// when it is not empty. A damaged chunk carries the wrong checksum.
+func chunk(offset int64, payload string, damaged bool) *Frame {
+	if payload == "" {
+		payload = contents[offset:min(offset+4, int64(len(contents)))]
+	}
+	checksum := Checksum([]byte(payload))
+	if damaged {
+		checksum = Checksum([]byte("damaged"))
+	}
+	return &Frame{Kind: Data, Offset: offset, Checksum: checksum, Payload: []byte(payload)}
+}
+
+// replies drains what the receiver sent, as kind and offset
+func replies(t *testing.T, sender *zmq.Socket) []string {
+	t.Helper()
+	var got []string
+	for {
+		frames, err := sender.RecvMessageBytes(zmq.DONTWAIT)
+		if zmq.AsErrno(err) == zmq.Errno(syscall.EAGAIN) {
+			return got
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := Decode(frames)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, fmt.Sprintf("%s %d", f.Kind, f.Offset))
+	}
+}
+
+func TestIncomingData(t *testing.T) {
+	type arrival struct {
+		offset  int64
+		payload string // the chunk of contents when empty
+		damaged bool
+	}
+
+	tests := []struct {
+		name        string
+		arrivals    []arrival
+		wantWritten int64
+		wantAhead   []int64
+		wantReplies []string
+	}{
+		{
+			name:        "in order",
+			arrivals:    []arrival{{offset: 0}, {offset: 4}, {offset: 8}},
+			wantWritten: 10,
+			wantReplies: []string{"CREDIT 4", "CREDIT 8", "CREDIT 10"},
+		},
+		{
+			name:        "out of order",
+			arrivals:    []arrival{{offset: 8}, {offset: 4}, {offset: 0}},
+			wantWritten: 10,
+			wantReplies: []string{"CREDIT 0", "CREDIT 0", "CREDIT 10"},
+		},
+		{
+			name:        "gap stays open",
+			arrivals:    []arrival{{offset: 4}, {offset: 8}},
+			wantWritten: 0,
+			wantAhead:   []int64{4, 8},
+			wantReplies: []string{"CREDIT 0", "CREDIT 0"},
+		},
+		{
+			name:        "gap closes part way",
+			arrivals:    []arrival{{offset: 8}, {offset: 0}},
+			wantWritten: 4,
+			wantAhead:   []int64{8},
+			wantReplies: []string{"CREDIT 0", "CREDIT 4"},
+		},
+		{
+			// Sent again after a resume, and not written over what we have
+			name: "duplicates after resume",
+			arrivals: []arrival{
+				{offset: 0}, {offset: 8},
+				{offset: 0, payload: "abcd"}, {offset: 8, payload: "xy"},
+				{offset: 4},
+			},
+			wantWritten: 10,
+			wantReplies: []string{"CREDIT 4", "CREDIT 4", "CREDIT 4", "CREDIT 4", "CREDIT 10"},
+		},
+		{
+			name:        "damaged chunk is asked for again",
+			arrivals:    []arrival{{offset: 0, damaged: true}, {offset: 0}},
+			wantWritten: 4,
+			wantReplies: []string{"RETRY 0", "CREDIT 0", "CREDIT 4"},
+		},
+		{
+			name:        "damaged chunk ahead of a gap",
+			arrivals:    []arrival{{offset: 4, damaged: true}, {offset: 0}, {offset: 4}},
+			wantWritten: 8,
+			wantReplies: []string{"RETRY 4", "CREDIT 0", "CREDIT 4", "CREDIT 8"},
+		},
+		{
+			name:        "chunk too large",
+			arrivals:    []arrival{{offset: 0, payload: "01234"}},
+			wantWritten: 0,
+			wantReplies: []string{"CREDIT 0"},
+		},
+		{
+			name:        "chunk past the end",
+			arrivals:    []arrival{{offset: 8, payload: "89ab"}},
+			wantWritten: 0,
+			wantReplies: []string{"CREDIT 0"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in, sender := newIncoming(t)
+			for _, a := range tt.arrivals {
+				if err := in.data(in.Sockets[0], chunk(a.offset, a.payload, a.damaged)); err != nil {
+					t.Fatalf("data at offset %d: %v", a.offset, err)
+				}
+			}
+
+			if in.written != tt.wantWritten {
+				t.Errorf("written %d, want %d", in.written, tt.wantWritten)
+			}
+			var ahead []int64
+			for offset := range in.ahead {
+				ahead = append(ahead, offset)
+			}
+			sort.Slice(ahead, func(i, j int) bool { return ahead[i] < ahead[j] })
+			if !reflect.DeepEqual(ahead, tt.wantAhead) {
+				t.Errorf("ahead %v, want %v", ahead, tt.wantAhead)
+			}
+			if got := replies(t, sender); !reflect.DeepEqual(got, tt.wantReplies) {
+				t.Errorf("replies %q, want %q", got, tt.wantReplies)
+			}
+
+			data, err := os.ReadFile(in.file.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := string(data[:in.written]); got != contents[:in.written] {
+				t.Errorf("file starts %q, want %q", got, contents[:in.written])
+			}
+		})
+	}
+}
+
+func TestIncomingDataCorrupt(t *testing.T) {
+	in, sender := newIncoming(t)
+	for i := 0; i < maxRetries; i++ {
+		if err := in.data(in.Sockets[0], chunk(0, "", true)); err != nil {
+			t.Fatalf("damaged chunk %d: %v", i+1, err)
+		}
+	}
+	if err := in.data(in.Sockets[0], chunk(0, "", true)); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("damaged chunk %d: %v, want ErrCorrupt", maxRetries+1, err)
+	}
+	replies(t, sender)
+}
+
+func TestIncomingDataBeforeGrant(t *testing.T) {
+	in, sender := newIncoming(t)
+	// A resume the sender has not answered yet
+	in.epoch++
+
+	if err := in.data(in.Sockets[0], chunk(0, "", false)); err != nil {
+		t.Fatal(err)
+	}
+	if in.written != 4 {
+		t.Errorf("written %d, want 4", in.written)
+	}
+	if got := replies(t, sender); len(got) != 0 {
+		t.Errorf("replies %q, want no credit for a chunk sent on the old grant", got)
+	}
+
+	in.granted[in.Sockets[0]] = in.epoch
+	if err := in.data(in.Sockets[0], chunk(4, "", false)); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := replies(t, sender), []string{"CREDIT 8"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("replies %q, want %q", got, want)
+	}
+}
@@ -54,67 +54,80 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
-	"os"
+	"path/filepath"
 
+	"github.com/maulikxg/ZeroMQ/test/filetransfer"
 	zmq "github.com/pebbe/zmq4"
 )
 
 const (
-	outputFilePath = "received_test.txt" // Path to save the received file
+	outputDir = "received" // Directory to save the received file in
 )
 
 func main() {
-	// Create a ZeroMQ context
-	context, err := zmq.NewContext()
-	if err != nil {
-		log.Fatal("Failed to create ZeroMQ context:", err)
+	pipeline := flag.Int("pipeline", filetransfer.DefaultPipeline, "chunks the pusher may have in flight on each stream")
+	streams := flag.Int("streams", filetransfer.DefaultStreams, "TCP streams to carry chunks in parallel")
+	endpoint := flag.String("connect", "tcp://localhost:5555", "the PUSH server's endpoint")
+	dir := flag.String("dir", outputDir, "directory to save the file in, under the pusher's name for it")
+	flag.Parse()
+	if *streams < 1 {
+		log.Fatal("-streams must be at least 1")
 	}
-
-	// Create a PULL socket
-	socket, err := context.NewSocket(zmq.PULL)
-	if err != nil {
-		log.Fatal("Failed to create PULL socket:", err)
+	if *pipeline < 1 {
+		log.Fatal("-pipeline must be at least 1")
 	}
-	defer socket.Close()
-
-	// Connect to the PUSH server
-	err = socket.Connect("tcp://localhost:5555")
-	if err != nil {
-		log.Fatal("Failed to connect to PUSH server:", err)
-	}
-
-	fmt.Println("PULL Worker Connected...")
 
-	// Create or truncate the output file
-	file, err := os.Create(outputFilePath)
+	// Create a ZeroMQ context
+	context, err := zmq.NewContext()
 	if err != nil {
-		log.Fatal("Failed to create output file:", err)
+		log.Fatal("Failed to create ZeroMQ context:", err)
 	}
-	defer file.Close()
 
-	// Receive and write chunks
-	i := 0
-	for {
-		// Receive a chunk
-		chunk, err := socket.Recv(0)
+	// Create the DEALER sockets, each a TCP stream of its own; we pull by
+	// granting the pusher credit on each
+	context.SetIoThreads(*streams)
+	sockets := make([]*zmq.Socket, *streams)
+	for i := range sockets {
+		sockets[i], err = context.NewSocket(zmq.DEALER)
 		if err != nil {
-			log.Fatal("Failed to receive chunk:", err)
+			log.Fatal("Failed to create DEALER socket:", err)
 		}
 
-		// Write the chunk to the file
-		_, err = file.WriteString(chunk)
+		// Connect to the PUSH server
+		err = sockets[i].Connect(*endpoint)
 		if err != nil {
-			log.Fatal("Failed to write chunk to file:", err)
+			log.Fatal("Failed to connect to PUSH server:", err)
 		}
+	}
 
-		fmt.Printf("Received chunk (%d bytes)\n", len(chunk))
-		fmt.Println(i)
-		i++
+	fmt.Println("PULL Worker Connected...")
 
-		// time.Sleep(time.Second * 1)
+	// Receive and write chunks
+	receiver := &filetransfer.Receiver{
+		Sockets:  sockets,
+		Pipeline: *pipeline,
+		Dir:      *dir,
+		Received: func(offset int64, size int) {
+			fmt.Printf("Received chunk at offset %d (%d bytes)\n", offset, size)
+		},
+		Waiting: func() {
+			fmt.Println("The pusher is busy with another receiver; waiting for it to finish")
+		},
+	}
+	header, err := receiver.Receive()
+
+	// Closing waits for our last word to reach the pusher
+	for _, socket := range sockets {
+		socket.Close()
+	}
+	context.Term()
+	if err != nil {
+		log.Fatal("Failed to receive file:", err)
 	}
 
-	fmt.Println("File received and saved successfully as", outputFilePath)
+	fmt.Printf("File received, verified and saved successfully as %s (%d bytes, mode %v)\n",
+		filepath.Join(*dir, header.Name), header.Size, header.Mode)
 }
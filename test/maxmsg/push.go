@@ -1,93 +1,106 @@
 package main
 
 import (
+	"flag"
 	"fmt"
-	zmq "github.com/pebbe/zmq4"
 	"log"
 	"os"
-	"time"
+
+	"github.com/maulikxg/ZeroMQ/test/filetransfer"
+	zmq "github.com/pebbe/zmq4"
 )
 
 const (
-	chunk    = 2 * 1024 * 1024 * 1024  // 1 MB chunks (adjust as needed)
-	fileSize = 10 * 1024 * 1024 * 1024 // 4 GB file size
+	fileSize = 10 * 1024 * 1024 * 1024 // 10 GB file size
 	filename = "test.txt"              // Path to the file to send
 )
 
+// createDummyFile writes fileSize bytes of zeroes to filename
+func createDummyFile() {
+	fmt.Println("Creating the dummy file")
+	file, err := os.Create(filename)
+	if err != nil {
+		log.Fatal("Failed to create file:", err)
+	}
+	defer file.Close()
+
+	// write the data to the file
+	fmt.Println("Writing the data to the file")
+	dummyData := make([]byte, filetransfer.DefaultChunkSize)
+
+	for i := 0; i < fileSize/len(dummyData); i++ {
+		_, err = file.Write(dummyData)
+		if err != nil {
+			log.Fatal("Failed to write data to file:", err)
+		}
+	}
+
+	fmt.Println("File written successfully")
+}
+
 func main() {
+	chunkSize := flag.Int("chunk", filetransfer.DefaultChunkSize, "bytes per chunk sent")
+	ioThreads := flag.Int("io-threads", filetransfer.DefaultStreams, "ZeroMQ I/O threads, to serve the puller's streams in parallel")
+	flag.Parse()
+	if *chunkSize < 1 {
+		log.Fatal("-chunk must be at least 1")
+	}
+	if *ioThreads < 1 {
+		log.Fatal("-io-threads must be at least 1")
+	}
+
 	// Create a ZeroMQ context
 	context, err := zmq.NewContext()
 	if err != nil {
 		log.Fatal("Failed to create ZeroMQ context:", err)
 	}
+	context.SetIoThreads(*ioThreads)
 
-	// Create a PUSH socket
-	socket, err := context.NewSocket(zmq.PUSH)
+	// Create a ROUTER socket; the puller connects and grants us credit
+	socket, err := context.NewSocket(zmq.ROUTER)
 	if err != nil {
-		log.Fatal("Failed to create PUSH socket:", err)
+		log.Fatal("Failed to create ROUTER socket:", err)
 	}
 	defer socket.Close()
+	socket.SetRouterMandatory(1)
 
 	// Bind the socket to a TCP address
 	err = socket.Bind("tcp://*:5555")
 	if err != nil {
-		log.Fatal("Failed to bind PUSH socket:", err)
+		log.Fatal("Failed to bind ROUTER socket:", err)
 	}
 
 	fmt.Println("PUSH Server Started...")
 
 	// for file stuff
 
-	// create the new dummy file
-	fmt.Println("Creating the dummy file")
-	file, err := os.Create(filename)
-	if err != nil {
-		log.Fatal("Failed to create file:", err)
-	}
-	defer file.Close()
-
-	// write the data to the file
-	fmt.Println("Writing the data to the file")
-	dummyData := make([]byte, chunk)
-
-	for i := 0; i < fileSize/chunk; i++ {
-		_, err = file.Write(dummyData)
-		if err != nil {
-			log.Fatal("Failed to write data to file:", err)
-		}
+	// create the new dummy file, unless an earlier run left it behind:
+	// rewriting it under a resumed transfer would be wasted time
+	if info, err := os.Stat(filename); err == nil && info.Size() == fileSize {
+		fmt.Println("Reusing the dummy file")
+	} else {
+		createDummyFile()
 	}
 
-	fmt.Println("File written successfully")
-
 	// open file for reading
-	file, err = os.Open(filename)
+	file, err := os.Open(filename)
 	if err != nil {
-		log.Println("Error opening file")
+		log.Fatal("Error opening file:", err)
 	}
+	defer file.Close()
 
-	// read the data from the file
-	buffer := make([]byte, chunk)
-	chunkID := 0
-
-	for {
-		n, err := file.Read(buffer)
-		if err != nil {
-			if err.Error() == "EOF" {
-				break // End of file reached
-			}
-			log.Fatal("Failed to read file:", err)
-		}
-
-		// Send the chunk
-		_, err = socket.SendBytes(buffer[:n], 0)
-		if err != nil {
-			log.Fatal("Failed to send chunk:", err)
-		}
-
-		fmt.Printf("Sent chunk %d (%d bytes)\n", chunkID, n)
-		chunkID++
-
-		time.Sleep(time.Second * 1)
+	// Send the file as fast as the puller's credit allows, once it is
+	// hashed for the manifest
+	fmt.Println("Hashing the file and waiting for the puller...")
+	sender := &filetransfer.Sender{
+		Socket:    socket,
+		ChunkSize: *chunkSize,
+		Sent: func(offset int64, size int) {
+			fmt.Printf("Sent chunk at offset %d (%d bytes)\n", offset, size)
+		},
+	}
+	if err := sender.Send(file); err != nil {
+		log.Fatal("Failed to send file:", err)
 	}
 
 	fmt.Println("File sent successfully")
@@ -2,40 +2,23 @@ package main
 
 import (
 	"encoding/binary"
+	"flag"
 	"fmt"
 	"log"
 	"os"
-	"time"
 
+	"github.com/maulikxg/ZeroMQ/test/filetransfer"
 	zmq "github.com/pebbe/zmq4"
 )
 
 const (
-	chunkSize = 1 * 1024 * 1024 * 1024 // 2MB chunks
-	fileSize  = 4 * 1024 * 1024 * 1024 // 4GB file
-	filename  = "utf16_ab_4gb.txt"
+	fileSize = 4 * 1024 * 1024 * 1024 // 4GB file
+	filename = "utf16_ab_4gb.txt"
+	bomSize  = 2
 )
 
-func main() {
-	context, err := zmq.NewContext()
-	if err != nil {
-		log.Fatal("Failed to create ZeroMQ context:", err)
-	}
-
-	socket, err := context.NewSocket(zmq.PUSH)
-	if err != nil {
-		log.Fatal("Failed to create PUSH socket:", err)
-	}
-	defer socket.Close()
-
-	err = socket.Bind("tcp://*:5555")
-	if err != nil {
-		log.Fatal("Failed to bind PUSH socket:", err)
-	}
-
-	fmt.Println("PUSH Server Started...")
-
-	// Create UTF-16 file
+// createFile writes the BOM and fileSize bytes of "ab" to filename
+func createFile() {
 	fmt.Println("Creating a 4GB UTF-16 file filled with 'ab'...")
 	file, err := os.Create(filename)
 	if err != nil {
@@ -47,14 +30,14 @@ func main() {
 	file.Write([]byte{0xFF, 0xFE})
 
 	// Create a buffer filled with "ab" in UTF-16 (Little Endian)
-	buffer := make([]byte, chunkSize)
-	for i := 0; i < chunkSize/4; i++ {
+	buffer := make([]byte, filetransfer.DefaultChunkSize)
+	for i := 0; i < len(buffer)/4; i++ {
 		binary.LittleEndian.PutUint16(buffer[i*4:], 'a')   // 'a' -> 0x0061
 		binary.LittleEndian.PutUint16(buffer[i*4+2:], 'b') // 'b' -> 0x0062
 	}
 
 	// Write buffer repeatedly to reach 4GB
-	for i := 0; i < fileSize/chunkSize; i++ {
+	for i := 0; i < fileSize/len(buffer); i++ {
 		_, err = file.Write(buffer)
 		if err != nil {
 			log.Fatal("Failed to write data to file:", err)
@@ -62,36 +45,66 @@ func main() {
 	}
 
 	fmt.Println("UTF-16 file created successfully.")
+}
 
-	// Open the file for reading
-	file, err = os.Open(filename)
+func main() {
+	sendChunk := flag.Int("chunk", filetransfer.DefaultChunkSize, "bytes per chunk sent")
+	ioThreads := flag.Int("io-threads", filetransfer.DefaultStreams, "ZeroMQ I/O threads, to serve the puller's streams in parallel")
+	flag.Parse()
+	if *sendChunk < 1 {
+		log.Fatal("-chunk must be at least 1")
+	}
+	if *ioThreads < 1 {
+		log.Fatal("-io-threads must be at least 1")
+	}
+
+	context, err := zmq.NewContext()
 	if err != nil {
-		log.Fatal("Error opening file:", err)
+		log.Fatal("Failed to create ZeroMQ context:", err)
 	}
-	defer file.Close()
+	context.SetIoThreads(*ioThreads)
 
-	// Send file in chunks
-	readBuffer := make([]byte, chunkSize)
-	chunkID := 0
+	socket, err := context.NewSocket(zmq.ROUTER)
+	if err != nil {
+		log.Fatal("Failed to create ROUTER socket:", err)
+	}
+	defer socket.Close()
+	socket.SetRouterMandatory(1)
 
-	for {
-		n, err := file.Read(readBuffer)
-		if err != nil {
-			if err.Error() == "EOF" {
-				break
-			}
-			log.Fatal("Failed to read file:", err)
-		}
+	err = socket.Bind("tcp://*:5555")
+	if err != nil {
+		log.Fatal("Failed to bind ROUTER socket:", err)
+	}
 
-		_, err = socket.SendBytes(readBuffer[:n], 0)
-		if err != nil {
-			log.Fatal("Failed to send chunk:", err)
-		}
+	fmt.Println("PUSH Server Started...")
 
-		fmt.Printf("Sent chunk %d (%d bytes)\n", chunkID, n)
-		chunkID++
+	// Create UTF-16 file, unless an earlier run left it behind for us to
+	// resume sending
+	if info, err := os.Stat(filename); err == nil && info.Size() == bomSize+fileSize {
+		fmt.Println("Reusing the existing UTF-16 file.")
+	} else {
+		createFile()
+	}
 
-		time.Sleep(time.Millisecond * 500) // Debugging delay
+	// Open the file for reading
+	file, err := os.Open(filename)
+	if err != nil {
+		log.Fatal("Error opening file:", err)
+	}
+	defer file.Close()
+
+	// Send file in chunks, as fast as the puller's credit allows, once
+	// it is hashed for the manifest
+	fmt.Println("Hashing the file and waiting for the puller...")
+	sender := &filetransfer.Sender{
+		Socket:    socket,
+		ChunkSize: *sendChunk,
+		Sent: func(offset int64, size int) {
+			fmt.Printf("Sent chunk at offset %d (%d bytes)\n", offset, size)
+		},
+	}
+	if err := sender.Send(file); err != nil {
+		log.Fatal("Failed to send file:", err)
 	}
 
 	fmt.Println("File sent successfully.")